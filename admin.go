@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pprofやメトリクスなどの管理用エンドポイント。公開ポートとは別のリスナーで待ち受ける
+func newAdminRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.HandleFunc("/debug/pprof/{name}", pprof.Index)
+	r.Handle("/debug/vars", expvar.Handler())
+	r.Get("/debug/queries", getDebugQueries)
+
+	return r
+}
+
+// 管理用のリスナーを起動する。シャットダウンできるようにhttp.Serverを返す
+func serveAdmin(addr string) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: newAdminRouter(),
+	}
+	log.Printf("admin listener on %s", addr)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Print(err)
+		}
+	}()
+	return server
+}
+
+// /initializeはDELETEを発行するので、X-Initialize-Tokenヘッダーでシークレットを渡したときだけ通す。
+// URLに載せるとアクセスログやトレースに残るので、クエリパラメータでは受け付けない。
+// シークレットを設定していなければ常に403を返す。
+// ベンチマーカーは公開ポートから/initializeを叩くので、benchmark_modeではチェックをしない
+func requireInitializeAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Admin.BenchmarkMode {
+			next(w, r)
+			return
+		}
+
+		secret := config.Admin.InitializeSecret
+		token := r.Header.Get("X-Initialize-Token")
+		if secret != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			next(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// trusted_proxiesを解析したもの。main()で設定を読み込んだあとに作る
+var trustedProxies []*net.IPNet
+
+// trusted_proxiesの各要素はCIDRかIPアドレス
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// リクエスト元のIPと、それが本当のクライアントのIPだとわかるかどうかを返す。
+// trusted_proxiesのプロキシから来たときだけX-Forwarded-Forを見て、右から順にたどって最初の信頼できないIPを使う
+// (左側はクライアントが偽装できるため)。trusted_proxiesを設定していないときにループバックから来たリクエストは、
+// X-Forwarded-Forを付けないプロキシ経由かもしれないので、わからないものとして扱う
+func clientIP(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host, false
+	}
+
+	if !isTrustedProxy(ip) {
+		if ip.IsLoopback() && len(trustedProxies) == 0 {
+			return host, false
+		}
+		return host, true
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return host, false
+		}
+		if !isTrustedProxy(hop) {
+			return hop.String(), true
+		}
+	}
+	return host, false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		xff     string
+		ip      string
+		ok      bool
+	}{
+		{"direct", nil, "203.0.113.1:1234", "", "203.0.113.1", true},
+		{"xff ignored without trusted proxies", nil, "203.0.113.1:1234", "198.51.100.1", "203.0.113.1", true},
+		{"loopback without trusted proxies", nil, "127.0.0.1:1234", "198.51.100.1", "127.0.0.1", false},
+		{"trusted proxy", []string{"127.0.0.1"}, "127.0.0.1:1234", "198.51.100.1", "198.51.100.1", true},
+		{"spoofed leftmost hop", []string{"127.0.0.1"}, "127.0.0.1:1234", "192.0.2.9, 198.51.100.1", "198.51.100.1", true},
+		{"chain of trusted proxies", []string{"127.0.0.1", "10.0.0.0/8"}, "127.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1", true},
+		{"trusted proxy without xff", []string{"127.0.0.1"}, "127.0.0.1:1234", "", "127.0.0.1", false},
+		{"all hops trusted", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "10.0.0.2", "10.0.0.1", false},
+		{"malformed xff", []string{"127.0.0.1"}, "127.0.0.1:1234", "unknown", "127.0.0.1", false},
+		{"untrusted loopback with trusted proxies", []string{"10.0.0.0/8"}, "127.0.0.1:1234", "198.51.100.1", "127.0.0.1", true},
+	}
+
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			trustedProxies, err = parseTrustedProxies(tt.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			ip, ok := clientIP(r)
+			if ip != tt.ip || ok != tt.ok {
+				t.Errorf("clientIP() = (%q, %v), want (%q, %v)", ip, ok, tt.ip, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"127.0.0.1", "::1", "10.0.0.0/8"}); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies([]string{s}); err == nil {
+			t.Errorf("parseTrustedProxies(%q) should fail", s)
+		}
+	}
+}
+
+func TestRequireInitializeAuth(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Admin.BenchmarkMode = false
+	config.Admin.InitializeSecret = "secret"
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		code   int
+	}{
+		{"header", "/initialize", "secret", http.StatusOK},
+		{"wrong header", "/initialize", "wrong", http.StatusForbidden},
+		{"query parameter", "/initialize?token=secret", "", http.StatusForbidden},
+		{"none", "/initialize", "", http.StatusForbidden},
+	}
+	h := requireInitializeAuth(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			if tt.header != "" {
+				r.Header.Set("X-Initialize-Token", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRequireInitializeAuthWithoutSecret(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Admin.BenchmarkMode = false
+	config.Admin.InitializeSecret = ""
+
+	h := requireInitializeAuth(func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest("GET", "/initialize", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// /admin/bannedのユーザー一覧の1ページの件数
+const adminUsersPerPage = 50
+
+// /admin/bannedで並べ替えられる列。キーはクエリパラメータのsort
+var adminUserSorts = map[string]string{
+	"created_at":    "`created_at`",
+	"account_name":  "`account_name`",
+	"post_count":    "`post_count`",
+	"comment_count": "`comment_count`",
+}
+
+// /admin/bannedの検索条件。クエリパラメータから作る
+type adminUserQuery struct {
+	Prefix string // アカウント名の前方一致
+	Status string // active(BANされていない)かbanned
+	Sort   string
+	Order  string // ascかdesc
+	Page   int    // 1始まり
+}
+
+func parseAdminUserQuery(v url.Values) adminUserQuery {
+	q := adminUserQuery{
+		Prefix: strings.TrimSpace(v.Get("q")),
+		Status: v.Get("status"),
+		Sort:   v.Get("sort"),
+		Order:  v.Get("order"),
+	}
+	if q.Status != "banned" {
+		q.Status = "active"
+	}
+	if _, ok := adminUserSorts[q.Sort]; !ok {
+		q.Sort = "created_at"
+	}
+	if q.Order != "asc" {
+		q.Order = "desc"
+	}
+	q.Page, _ = strconv.Atoi(v.Get("page"))
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+// 条件を保ったままページだけ変えたURL
+func (q adminUserQuery) pageURL(page int) string {
+	v := url.Values{}
+	if q.Prefix != "" {
+		v.Set("q", q.Prefix)
+	}
+	v.Set("status", q.Status)
+	v.Set("sort", q.Sort)
+	v.Set("order", q.Order)
+	v.Set("page", strconv.Itoa(page))
+	return "/admin/banned?" + v.Encode()
+}
+
+// LIKEの前方一致に使えるように%と_をエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// 条件に合うユーザーの1ページ分と、全体の件数を返す。管理者と自分は出さない
+func searchAdminUsers(ctx context.Context, me User, q adminUserQuery) ([]User, int, error) {
+	where := "WHERE `role` <> ? AND `id` <> ? AND `del_flg` = ?"
+	delFlg := 0
+	if q.Status == "banned" {
+		delFlg = 1
+	}
+	args := []interface{}{RoleAdmin, me.ID, delFlg}
+	if q.Prefix != "" {
+		where += " AND `account_name` LIKE ?"
+		args = append(args, escapeLike(q.Prefix)+"%")
+	}
+
+	total := 0
+	err := db.GetContext(ctx, &total, "SELECT COUNT(*) FROM `users` "+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// sortとorderはparseAdminUserQueryで決まった値しか入らない
+	order := adminUserSorts[q.Sort] + " " + strings.ToUpper(q.Order) + ", `id` " + strings.ToUpper(q.Order)
+	users := []User{}
+	err = db.SelectContext(ctx, &users,
+		"SELECT * FROM `users` "+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		append(args, adminUsersPerPage, (q.Page-1)*adminUsersPerPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// モデレーションの操作の種類。moderation_logs.actionに入れる
+const (
+	moderationBan    = "ban"
+	moderationUnban  = "unban"
+	moderationExpire = "expire"
+	moderationRole   = "role"
+	moderationLogout = "logout"
+)
+
+// BANされているユーザー。初期データのようにbansに記録のないBANはReasonなどが空になる
+type Ban struct {
+	UserID        int          `db:"user_id"`
+	AccountName   string       `db:"account_name"`
+	ModeratorName string       `db:"moderator_name"`
+	Reason        string       `db:"reason"`
+	StartedAt     sql.NullTime `db:"started_at"`
+	ExpiresAt     sql.NullTime `db:"expires_at"`
+}
+
+type ModerationLog struct {
+	ID            int       `db:"id"`
+	Action        string    `db:"action"`
+	Detail        string    `db:"detail"`
+	CreatedAt     time.Time `db:"created_at"`
+	ModeratorName string    `db:"moderator_name"`
+	TargetName    string    `db:"target_name"`
+}
+
+func logModeration(ctx context.Context, tx *Tx, moderatorID int, action string, targetID int, detail string) error {
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO `moderation_logs` (`moderator_id`, `action`, `target_user_id`, `detail`) VALUES (?, ?, ?, ?)",
+		moderatorID, action, targetID, detail)
+	return err
+}
+
+// banUsersの結果。Bannedが実際にBANしたユーザーで、残りはBANしなかった理由ごとの人数
+type banResult struct {
+	Banned        []int
+	Admins        int
+	Self          int
+	AlreadyBanned int
+	NotFound      int
+}
+
+// userIDsを1つのトランザクションでまとめてBANする。管理者と自分自身はBANしない。
+// expiresAtがゼロ値なら無期限
+func banUsers(ctx context.Context, moderatorID int, userIDs []int, reason string, expiresAt time.Time) (banResult, error) {
+	var res banResult
+	if len(userIDs) == 0 {
+		return res, nil
+	}
+
+	err := db.Transaction(ctx, func(tx *Tx) error {
+		res = banResult{}
+		query, args, err := sqlx.In("SELECT `id`, `role`, `del_flg` FROM `users` WHERE `id` IN (?) FOR UPDATE", userIDs)
+		if err != nil {
+			return err
+		}
+		var users []struct {
+			ID     int    `db:"id"`
+			Role   string `db:"role"`
+			DelFlg int    `db:"del_flg"`
+		}
+		if err := tx.SelectContext(ctx, &users, query, args...); err != nil {
+			return err
+		}
+
+		found := map[int]bool{}
+		for _, u := range users {
+			found[u.ID] = true
+			switch {
+			case u.ID == moderatorID:
+				res.Self++
+			case u.Role == RoleAdmin:
+				res.Admins++
+			case u.DelFlg != 0:
+				res.AlreadyBanned++
+			default:
+				res.Banned = append(res.Banned, u.ID)
+			}
+		}
+		for _, id := range userIDs {
+			if !found[id] {
+				res.NotFound++
+			}
+		}
+		if len(res.Banned) == 0 {
+			return nil
+		}
+
+		query, args, err = sqlx.In("UPDATE `users` SET `del_flg` = 1 WHERE `id` IN (?)", res.Banned)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+
+		expires := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+		if len(reason) > 255 {
+			reason = reason[:255]
+		}
+		var banArgs, logArgs []interface{}
+		for _, id := range res.Banned {
+			banArgs = append(banArgs, id, moderatorID, reason, expires)
+			logArgs = append(logArgs, moderatorID, moderationBan, id, reason)
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?), ", len(res.Banned)), ", ")
+		_, err = tx.ExecContext(ctx, "INSERT INTO `bans` (`user_id`, `moderator_id`, `reason`, `expires_at`) VALUES "+values, banArgs...)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO `moderation_logs` (`moderator_id`, `action`, `target_user_id`, `detail`) VALUES "+values, logArgs...)
+		return err
+	})
+	if err != nil {
+		return banResult{}, err
+	}
+	return res, nil
+}
+
+// 一括BANの結果を伝えるフラッシュメッセージ
+func (res banResult) notice() string {
+	notice := fmt.Sprintf("%d件のアカウントをBANしました", len(res.Banned))
+	var skipped []string
+	if res.Admins > 0 {
+		skipped = append(skipped, fmt.Sprintf("管理者%d件", res.Admins))
+	}
+	if res.Self > 0 {
+		skipped = append(skipped, "自分自身")
+	}
+	if res.AlreadyBanned > 0 {
+		skipped = append(skipped, fmt.Sprintf("BAN済み%d件", res.AlreadyBanned))
+	}
+	if res.NotFound > 0 {
+		skipped = append(skipped, fmt.Sprintf("存在しないアカウント%d件", res.NotFound))
+	}
+	if len(skipped) > 0 {
+		notice += "(" + strings.Join(skipped, "、") + "はBANしていません)"
+	}
+	return notice
+}
+
+// userIDのBANを解除する。BANされていなければ何もせずfalseを返す
+func unbanUser(ctx context.Context, moderatorID, userID int) (bool, error) {
+	unbanned := false
+	err := db.Transaction(ctx, func(tx *Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE `users` SET `del_flg` = 0 WHERE `id` = ? AND `del_flg` = 1", userID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = ? WHERE `user_id` = ? AND `lifted_at` IS NULL",
+			moderatorID, userID)
+		if err != nil {
+			return err
+		}
+		unbanned = true
+		return logModeration(ctx, tx, moderatorID, moderationUnban, userID, "")
+	})
+	if unbanned {
+		invalidateUserCache(ctx, userID)
+	}
+	return unbanned, err
+}
+
+// logoutUsersの結果。LoggedOutが実際にログアウトさせたユーザーで、残りはログアウトさせなかった理由ごとの人数
+type logoutResult struct {
+	LoggedOut []int
+	Admins    int
+	Self      int
+	NotFound  int
+}
+
+// unbanUsersの結果。解除した人数と、解除しなかった理由ごとの人数
+type unbanResult struct {
+	Unbanned  int
+	NotBanned int
+	Failed    int
+}
+
+// userIDsのBANを1人ずつ解除する。失敗したユーザーはログに出して数える
+func unbanUsers(ctx context.Context, moderatorID int, userIDs []int) unbanResult {
+	var res unbanResult
+	for _, id := range userIDs {
+		unbanned, err := unbanUser(ctx, moderatorID, id)
+		switch {
+		case err != nil:
+			log.Print(err)
+			res.Failed++
+		case unbanned:
+			res.Unbanned++
+		default:
+			res.NotBanned++
+		}
+	}
+	return res
+}
+
+// 一括解除の結果を伝えるフラッシュメッセージ
+func (res unbanResult) notice() string {
+	notice := fmt.Sprintf("%d件のアカウントのBANを解除しました", res.Unbanned)
+	var skipped []string
+	if res.NotBanned > 0 {
+		skipped = append(skipped, fmt.Sprintf("BANされていない%d件", res.NotBanned))
+	}
+	if res.Failed > 0 {
+		skipped = append(skipped, fmt.Sprintf("エラーになった%d件", res.Failed))
+	}
+	if len(skipped) > 0 {
+		notice += "(" + strings.Join(skipped, "、") + "は解除していません)"
+	}
+	return notice
+}
+
+// userIDsのセッションをすべて無効にして、ログインし直させる。banUsersと同じく管理者と自分自身は対象にしない
+func logoutUsers(ctx context.Context, moderatorID int, userIDs []int) (logoutResult, error) {
+	var res logoutResult
+	if len(userIDs) == 0 {
+		return res, nil
+	}
+
+	query, args, err := sqlx.In("SELECT `id`, `role` FROM `users` WHERE `id` IN (?)", userIDs)
+	if err != nil {
+		return res, err
+	}
+	var users []struct {
+		ID   int    `db:"id"`
+		Role string `db:"role"`
+	}
+	if err := db.SelectContext(ctx, &users, query, args...); err != nil {
+		return res, err
+	}
+
+	found := map[int]bool{}
+	for _, u := range users {
+		found[u.ID] = true
+		switch {
+		case u.ID == moderatorID:
+			res.Self++
+		case u.Role == RoleAdmin:
+			res.Admins++
+		default:
+			res.LoggedOut = append(res.LoggedOut, u.ID)
+		}
+	}
+	for _, id := range userIDs {
+		if !found[id] {
+			res.NotFound++
+		}
+	}
+	if len(res.LoggedOut) == 0 {
+		return res, nil
+	}
+
+	if err := revokeUserSessions(ctx, res.LoggedOut...); err != nil {
+		return logoutResult{}, err
+	}
+	err = db.Transaction(ctx, func(tx *Tx) error {
+		for _, id := range res.LoggedOut {
+			if err := logModeration(ctx, tx, moderatorID, moderationLogout, id, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return logoutResult{}, err
+	}
+	return res, nil
+}
+
+// 一括ログアウトの結果を伝えるフラッシュメッセージ
+func (res logoutResult) notice() string {
+	notice := fmt.Sprintf("%d件のアカウントをログアウトさせました", len(res.LoggedOut))
+	var skipped []string
+	if res.Admins > 0 {
+		skipped = append(skipped, fmt.Sprintf("管理者%d件", res.Admins))
+	}
+	if res.Self > 0 {
+		skipped = append(skipped, "自分自身")
+	}
+	if res.NotFound > 0 {
+		skipped = append(skipped, fmt.Sprintf("存在しないアカウント%d件", res.NotFound))
+	}
+	if len(skipped) > 0 {
+		notice += "(" + strings.Join(skipped, "、") + "はログアウトさせていません)"
+	}
+	return notice
+}
+
+// 期限の過ぎたBANを解除して、解除した人数を返す。複数のインスタンスで同時に動いても、
+// FOR UPDATEで先に取ったほうだけが解除する
+func expireBans(ctx context.Context) (int, error) {
+	var userIDs []int
+	err := db.Transaction(ctx, func(tx *Tx) error {
+		userIDs = nil
+		err := tx.SelectContext(ctx, &userIDs,
+			"SELECT `user_id` FROM `bans` WHERE `lifted_at` IS NULL AND `expires_at` <= NOW() FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		for _, id := range userIDs {
+			if _, err := tx.ExecContext(ctx, "UPDATE `users` SET `del_flg` = 0 WHERE `id` = ?", id); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				"UPDATE `bans` SET `lifted_at` = NOW() WHERE `user_id` = ? AND `lifted_at` IS NULL", id)
+			if err != nil {
+				return err
+			}
+			if err := logModeration(ctx, tx, 0, moderationExpire, id, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	invalidateUserCache(ctx, userIDs...)
+	return len(userIDs), nil
+}
+
+// ban.expire_intervalごとに期限の過ぎたBANを解除する
+func watchBanExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := expireBans(ctx); err != nil {
+				log.Print(err)
+			} else if n > 0 {
+				log.Printf("lifted %d expired bans", n)
+			}
+		}
+	}
+}
+
+// BANされているユーザーを新しい順に返す
+func listBans(ctx context.Context) ([]Ban, error) {
+	bans := []Ban{}
+	err := db.SelectContext(ctx, &bans,
+		"SELECT u.`id` AS user_id, u.`account_name`, "+
+			"COALESCE(m.`account_name`, '') AS moderator_name, COALESCE(b.`reason`, '') AS reason, "+
+			"b.`started_at`, b.`expires_at` "+
+			"FROM `users` AS u "+
+			"LEFT JOIN `bans` AS b ON b.`user_id` = u.`id` AND b.`lifted_at` IS NULL "+
+			"LEFT JOIN `users` AS m ON m.`id` = b.`moderator_id` "+
+			"WHERE u.`del_flg` = 1 "+
+			"ORDER BY b.`started_at` IS NULL, b.`started_at` DESC, u.`id` DESC "+
+			"LIMIT 100")
+	return bans, err
+}
+
+// モデレーションの操作を新しい順にn件返す
+func listModerationLogs(ctx context.Context, n int) ([]ModerationLog, error) {
+	logs := []ModerationLog{}
+	err := db.SelectContext(ctx, &logs,
+		"SELECT l.`id`, l.`action`, l.`detail`, l.`created_at`, "+
+			"COALESCE(m.`account_name`, '') AS moderator_name, COALESCE(t.`account_name`, '') AS target_name "+
+			"FROM `moderation_logs` AS l "+
+			"LEFT JOIN `users` AS m ON m.`id` = l.`moderator_id` "+
+			"LEFT JOIN `users` AS t ON t.`id` = l.`target_user_id` "+
+			"ORDER BY l.`id` DESC "+
+			"LIMIT ?", n)
+	return logs, err
+}
+
+// BANを解除する
+func postAdminUnban(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	uid, err := strconv.Atoi(r.FormValue("uid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := unbanUser(r.Context(), me.ID, uid); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
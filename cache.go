@@ -0,0 +1,303 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/sync/singleflight"
+)
+
+// プロセス内のLRUとmemcachedの2段構えのキャッシュ。タイムラインの上位20件のように
+// 何度も読まれるキーは、毎回ネットワーク越しにmemcachedへ取りに行かずに済む。
+// ほかのインスタンスでの更新はLRUのTTL(cache.local_ttl)が切れるまで見えないので、TTLは短くしておく
+type tieredCache struct {
+	local    *lruCache
+	localTTL time.Duration
+	remote   *tracedMemcache
+	group    singleflight.Group
+	fills    singleflight.Group
+	metrics  *expvar.Map
+}
+
+var appCache *tieredCache
+
+func newTieredCache(remote *tracedMemcache, localSize int, localTTL time.Duration) *tieredCache {
+	c := &tieredCache{
+		local:    newLRUCache(localSize),
+		localTTL: localTTL,
+		remote:   remote,
+		metrics:  new(expvar.Map).Init(),
+	}
+	// 管理用リスナーの/debug/varsで見られるようにする
+	if expvar.Get("cache") == nil {
+		expvar.Publish("cache", c.metrics)
+	}
+	return c
+}
+
+func (c *tieredCache) localEnabled() bool {
+	return c.localTTL > 0 && c.local.capacity > 0
+}
+
+func (c *tieredCache) Get(ctx context.Context, key string) (*memcache.Item, error) {
+	if c.localEnabled() {
+		if item, ok := c.local.Get(key); ok {
+			c.metrics.Add("local_hits", 1)
+			return item, nil
+		}
+		c.metrics.Add("local_misses", 1)
+	}
+
+	// 同じキーへの同時のミスは1回のmemcachedアクセスにまとめる
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		return c.remote.Get(ctx, key)
+	})
+	if err != nil {
+		c.countRemoteError(err)
+		return nil, err
+	}
+	item := v.(*memcache.Item)
+	c.metrics.Add("remote_hits", 1)
+	c.setLocal(item)
+	return item, nil
+}
+
+func (c *tieredCache) GetMulti(ctx context.Context, keys []string) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if c.localEnabled() {
+			if item, ok := c.local.Get(key); ok {
+				c.metrics.Add("local_hits", 1)
+				items[key] = item
+				continue
+			}
+			c.metrics.Add("local_misses", 1)
+		}
+		missing = append(missing, key)
+	}
+	if len(missing) == 0 {
+		return items, nil
+	}
+
+	sorted := append([]string(nil), missing...)
+	sort.Strings(sorted)
+	v, err, _ := c.group.Do("multi:"+strings.Join(sorted, " "), func() (interface{}, error) {
+		return c.remote.GetMulti(ctx, missing)
+	})
+	if err != nil {
+		c.countRemoteError(err)
+		return nil, err
+	}
+	remoteItems := v.(map[string]*memcache.Item)
+	c.metrics.Add("remote_hits", int64(len(remoteItems)))
+	c.metrics.Add("remote_misses", int64(len(missing)-len(remoteItems)))
+	for key, item := range remoteItems {
+		items[key] = item
+		c.setLocal(item)
+	}
+	return items, nil
+}
+
+func (c *tieredCache) Set(ctx context.Context, item *memcache.Item) error {
+	c.setLocal(item)
+	return c.remote.Set(ctx, item)
+}
+
+func (c *tieredCache) Delete(ctx context.Context, key string) error {
+	c.local.Delete(key)
+	return c.remote.Delete(ctx, key)
+}
+
+// ローカルのLRUとmemcachedを空にする。ほかのインスタンスのLRUはcache.local_ttlが切れるまで残る
+func (c *tieredCache) Flush(ctx context.Context) error {
+	c.local.Purge()
+	return c.remote.FlushAll(ctx)
+}
+
+// Fetchで保存する値の先頭に付けるヘッダー。マジックバイトとソフトTTLの期限(UnixNano)
+const (
+	fetchHeaderMagic = 0xff
+	fetchHeaderSize  = 9
+)
+
+// キャッシュスタンピード対策付きの読み込み。値にはソフトTTLの期限を埋め込んでおき、
+//   - ソフトTTL内ならそのまま返す
+//   - ソフトTTLを過ぎていたら古い値を返しつつ、裏で1回だけloadして作り直す(stale-while-revalidate)
+//   - キャッシュになければloadする。同じキーへの同時のミスは1回のloadにまとめる
+//
+// memcachedの有効期限(hardTTL)とソフトTTLはどちらも揺らして、同時にセットしたキーが一斉に切れないようにする
+func (c *tieredCache) Fetch(ctx context.Context, key string, softTTL, hardTTL time.Duration, load func(context.Context) ([]byte, error)) ([]byte, error) {
+	item, err := c.Get(ctx, key)
+	if err == nil && len(item.Value) >= fetchHeaderSize && item.Value[0] == fetchHeaderMagic {
+		softExpires := time.Unix(0, int64(binary.BigEndian.Uint64(item.Value[1:fetchHeaderSize])))
+		value := item.Value[fetchHeaderSize:]
+		if time.Now().Before(softExpires) {
+			return value, nil
+		}
+
+		c.metrics.Add("stale_hits", 1)
+		c.fills.DoChan(key, func() (interface{}, error) {
+			// リクエストが終わってもキャンセルされないように、別のctxで作り直す
+			refreshCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			v, err := c.fill(refreshCtx, key, softTTL, hardTTL, load)
+			if err != nil {
+				log.Print(err)
+			}
+			return v, err
+		})
+		return value, nil
+	}
+	if err != nil && err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+	// ヘッダーのない古い形式の値はキャッシュミスとして作り直す
+
+	v, err, _ := c.fills.Do(key, func() (interface{}, error) {
+		return c.fill(ctx, key, softTTL, hardTTL, load)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (c *tieredCache) fill(ctx context.Context, key string, softTTL, hardTTL time.Duration, load func(context.Context) ([]byte, error)) ([]byte, error) {
+	c.metrics.Add("fills", 1)
+	value, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, fetchHeaderSize+len(value))
+	buf[0] = fetchHeaderMagic
+	binary.BigEndian.PutUint64(buf[1:fetchHeaderSize], uint64(time.Now().Add(jitter(softTTL)).UnixNano()))
+	copy(buf[fetchHeaderSize:], value)
+	err = c.Set(ctx, &memcache.Item{Key: key, Value: buf, Expiration: jitteredExpiration(hardTTL)})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// dを最大20%だけランダムに伸ばす
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// memcachedのExpiration(秒)にする。揺らした結果が0秒にならないようにする
+func jitteredExpiration(d time.Duration) int32 {
+	sec := int32(jitter(d) / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+func (c *tieredCache) setLocal(item *memcache.Item) {
+	if !c.localEnabled() {
+		return
+	}
+	ttl := c.localTTL
+	if item.Expiration > 0 && time.Duration(item.Expiration)*time.Second < ttl {
+		ttl = time.Duration(item.Expiration) * time.Second
+	}
+	c.local.Set(item, ttl)
+}
+
+func (c *tieredCache) countRemoteError(err error) {
+	if err == memcache.ErrCacheMiss {
+		c.metrics.Add("remote_misses", 1)
+		return
+	}
+	c.metrics.Add("remote_errors", 1)
+}
+
+// 件数上限付きのLRU。期限切れのエントリは読んだときに捨てる
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	item    memcache.Item
+	expires time.Time
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ll:       list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key string) (*memcache.Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	item := e.item
+	return &item, true
+}
+
+func (c *lruCache) Set(item *memcache.Item, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &lruEntry{item: *item, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[item.Key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[item.Key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).item.Key)
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = map[string]*list.Element{}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// アプリの設定。優先順位は デフォルト値 < 設定ファイル(YAML) < 環境変数 < コマンドラインフラグ
+type Config struct {
+	Listen       string        `yaml:"listen"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	ImageDir     string        `yaml:"image_dir"`
+	PublicDir    string        `yaml:"public_dir"`
+	// X-Forwarded-Forを信用するプロキシ(CIDRかIPアドレス)。空ならX-Forwarded-Forは見ない
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	Session struct {
+		// cookie、memcached、redisのどれにセッションを置くか
+		Backend string `yaml:"backend"`
+		// 署名と暗号化の鍵の元になるシークレット。先頭が新しい鍵で、残りは古いCookieを読むためだけに使う
+		Secrets   []string `yaml:"secrets"`
+		KeyPrefix string   `yaml:"key_prefix"`
+
+		Secure   bool          `yaml:"secure"`
+		SameSite string        `yaml:"same_site"`
+		MaxAge   time.Duration `yaml:"max_age"`
+		// max_ageを過ぎたuser_sessionsの行を消す間隔
+		PurgeInterval time.Duration `yaml:"purge_interval"`
+
+		Redis struct {
+			Address  string `yaml:"address"`
+			Password string `yaml:"password"`
+			DB       int    `yaml:"db"`
+		} `yaml:"redis"`
+	} `yaml:"session"`
+
+	Login struct {
+		// アカウント名ごと、IPごとに何回失敗したらロックするか。0なら数えない
+		MaxFailures   int           `yaml:"max_failures"`
+		IPMaxFailures int           `yaml:"ip_max_failures"`
+		Lockout       time.Duration `yaml:"lockout"`
+		// 最後の失敗からこの時間が経ったら失敗回数を忘れる
+		Window time.Duration `yaml:"window"`
+		// 何回目の失敗から待ち時間を入れるか。待ち時間はbackoff_baseから倍々にしてbackoff_maxで止める
+		BackoffAfter int           `yaml:"backoff_after"`
+		BackoffBase  time.Duration `yaml:"backoff_base"`
+		BackoffMax   time.Duration `yaml:"backoff_max"`
+	} `yaml:"login"`
+
+	// 投稿とコメントの回数制限。rateは1秒あたりに増えるトークン数、burstは貯められる上限。rateが0なら制限しない
+	RateLimit struct {
+		Post      rateLimitRule `yaml:"post"`
+		PostIP    rateLimitRule `yaml:"post_ip"`
+		Comment   rateLimitRule `yaml:"comment"`
+		CommentIP rateLimitRule `yaml:"comment_ip"`
+	} `yaml:"rate_limit"`
+
+	Ban struct {
+		// 期限の過ぎたBANを解除する間隔
+		ExpireInterval time.Duration `yaml:"expire_interval"`
+	} `yaml:"ban"`
+
+	Admin struct {
+		Listen           string `yaml:"listen"`
+		BenchmarkMode    bool   `yaml:"benchmark_mode"`
+		InitializeSecret string `yaml:"initialize_secret"`
+	} `yaml:"admin"`
+
+	Shutdown struct {
+		Timeout time.Duration `yaml:"timeout"`
+		Delay   time.Duration `yaml:"delay"`
+	} `yaml:"shutdown"`
+
+	DB struct {
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		Name     string `yaml:"name"`
+
+		MaxOpenConns    int           `yaml:"max_open_conns"`
+		MaxIdleConns    int           `yaml:"max_idle_conns"`
+		ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+		ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+
+		InterpolateParams bool          `yaml:"interpolate_params"`
+		DialTimeout       time.Duration `yaml:"dial_timeout"`
+		ReadTimeout       time.Duration `yaml:"read_timeout"`
+		WriteTimeout      time.Duration `yaml:"write_timeout"`
+		TLS               string        `yaml:"tls"`
+
+		// 起動時にMySQLが上がってくるのを待つ時間
+		ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+		// 読み込み専用クエリを振り分けるレプリカ(host:port)。空ならすべてプライマリに投げる
+		Replicas             []string      `yaml:"replicas"`
+		ReplicaCheckInterval time.Duration `yaml:"replica_check_interval"`
+	} `yaml:"db"`
+
+	Memcached struct {
+		Address string `yaml:"address"`
+	} `yaml:"memcached"`
+
+	Cache struct {
+		// memcachedの手前に置くプロセス内LRUの件数とTTL。TTLが0ならLRUを使わない
+		LocalSize int           `yaml:"local_size"`
+		LocalTTL  time.Duration `yaml:"local_ttl"`
+		// posts.comment_countがあるので通常は不要。memcachedの"comments.<id>.count"も使うならtrue
+		CommentCounts bool `yaml:"comment_counts"`
+		// makePostsのコメント一覧のキャッシュ。ソフトTTLを過ぎたら裏で作り直し、ハードTTLでmemcachedから消える
+		CommentsSoftTTL time.Duration `yaml:"comments_soft_ttl"`
+		CommentsHardTTL time.Duration `yaml:"comments_hard_ttl"`
+		// タイムラインの投稿HTMLを断片としてキャッシュするか。off、on、compare(キャッシュなしの結果と比べる)
+		Fragments string `yaml:"fragments"`
+	} `yaml:"cache"`
+
+	Trace struct {
+		Exporter    string  `yaml:"exporter"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"trace"`
+
+	SlowQuery struct {
+		Threshold time.Duration `yaml:"threshold"`
+		Explain   bool          `yaml:"explain"`
+	} `yaml:"slow_query"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	c := Config{
+		Listen:       ":8080",
+		ReadTimeout:  110 * time.Second,
+		WriteTimeout: 110 * time.Second,
+		ImageDir:     "/home/isucon/private_isu/webapp/public/image",
+		PublicDir:    "../public",
+	}
+	c.Session.Backend = "memcached"
+	c.Session.Secrets = []string{"sendagaya"}
+	c.Session.KeyPrefix = "iscogram_"
+	c.Session.SameSite = "lax"
+	c.Session.MaxAge = 30 * 24 * time.Hour
+	c.Session.PurgeInterval = 10 * time.Minute
+	c.Session.Redis.Address = "localhost:6379"
+	c.Login.MaxFailures = 5
+	c.Login.IPMaxFailures = 100
+	c.Login.Lockout = 15 * time.Minute
+	c.Login.Window = 15 * time.Minute
+	c.Login.BackoffAfter = 3
+	c.Login.BackoffBase = time.Second
+	c.Login.BackoffMax = 30 * time.Second
+	c.RateLimit.Post = rateLimitRule{Rate: 0.2, Burst: 10}
+	c.RateLimit.PostIP = rateLimitRule{Rate: 20, Burst: 200}
+	c.RateLimit.Comment = rateLimitRule{Rate: 1, Burst: 20}
+	c.RateLimit.CommentIP = rateLimitRule{Rate: 100, Burst: 500}
+	c.Ban.ExpireInterval = time.Minute
+	c.Admin.Listen = "localhost:6060"
+	c.Shutdown.Timeout = 10 * time.Second
+	// ロードバランサーが/readyzの失敗に気づくまで、少なくともヘルスチェック1回ぶんは待つ
+	c.Shutdown.Delay = 5 * time.Second
+	c.DB.Host = "localhost"
+	c.DB.Port = 3306
+	c.DB.User = "root"
+	c.DB.Name = "isuconp"
+	c.DB.MaxOpenConns = 50
+	c.DB.MaxIdleConns = 50
+	c.DB.ConnMaxLifetime = 5 * time.Minute
+	c.DB.InterpolateParams = true
+	c.DB.DialTimeout = 5 * time.Second
+	c.DB.ConnectTimeout = 30 * time.Second
+	c.DB.ReplicaCheckInterval = 5 * time.Second
+	c.Memcached.Address = "localhost:11211"
+	c.Cache.LocalSize = 1000
+	c.Cache.LocalTTL = time.Second
+	c.Cache.CommentsSoftTTL = 10 * time.Second
+	c.Cache.CommentsHardTTL = time.Minute
+	c.Cache.Fragments = "off"
+	c.Trace.SampleRatio = 1
+	c.SlowQuery.Threshold = 100 * time.Millisecond
+	return c
+}
+
+// 設定項目ひとつぶん。keyは設定ファイルでのパス、envとflagはそれぞれの名前
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	secret bool
+	ptr    interface{}
+	usage  string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "ISUCONP_LISTEN_ADDRESS", "listen", false, &c.Listen, "address of the public listener"},
+		{"read_timeout", "ISUCONP_READ_TIMEOUT", "read-timeout", false, &c.ReadTimeout, "read timeout of the public listener"},
+		{"write_timeout", "ISUCONP_WRITE_TIMEOUT", "write-timeout", false, &c.WriteTimeout, "write timeout of the public listener"},
+		{"image_dir", "ISUCONP_IMAGE_DIR", "image-dir", false, &c.ImageDir, "directory to write uploaded images to"},
+		{"public_dir", "ISUCONP_PUBLIC_DIR", "public-dir", false, &c.PublicDir, "directory of static files"},
+		{"trusted_proxies", "ISUCONP_TRUSTED_PROXIES", "trusted-proxies", false, &c.TrustedProxies, "comma separated CIDRs or IPs of proxies whose X-Forwarded-For is trusted"},
+		{"session.backend", "ISUCONP_SESSION_BACKEND", "session-backend", false, &c.Session.Backend, "where to store sessions (cookie, memcached or redis)"},
+		{"session.secrets", "ISUCONP_SESSION_SECRETS", "session-secrets", true, &c.Session.Secrets, "comma separated secrets for session cookies, newest first"},
+		{"session.key_prefix", "ISUCONP_SESSION_KEY_PREFIX", "session-key-prefix", false, &c.Session.KeyPrefix, "key prefix of sessions in memcached or Redis"},
+		{"session.secure", "ISUCONP_SESSION_SECURE", "session-secure", false, &c.Session.Secure, "send session cookies only over HTTPS"},
+		{"session.same_site", "ISUCONP_SESSION_SAME_SITE", "session-same-site", false, &c.Session.SameSite, "SameSite attribute of session cookies (lax, strict or none)"},
+		{"session.max_age", "ISUCONP_SESSION_MAX_AGE", "session-max-age", false, &c.Session.MaxAge, "lifetime of sessions"},
+		{"session.purge_interval", "ISUCONP_SESSION_PURGE_INTERVAL", "session-purge-interval", false, &c.Session.PurgeInterval, "how often to delete expired sessions"},
+		{"session.redis.address", "ISUCONP_SESSION_REDIS_ADDRESS", "session-redis-address", false, &c.Session.Redis.Address, "Redis address for the redis session backend"},
+		{"session.redis.password", "ISUCONP_SESSION_REDIS_PASSWORD", "session-redis-password", true, &c.Session.Redis.Password, "Redis password"},
+		{"session.redis.db", "ISUCONP_SESSION_REDIS_DB", "session-redis-db", false, &c.Session.Redis.DB, "Redis database number"},
+		{"login.max_failures", "ISUCONP_LOGIN_MAX_FAILURES", "login-max-failures", false, &c.Login.MaxFailures, "lock an account after this many failed logins (0 to disable)"},
+		{"login.ip_max_failures", "ISUCONP_LOGIN_IP_MAX_FAILURES", "login-ip-max-failures", false, &c.Login.IPMaxFailures, "lock a client IP after this many failed logins (0 to disable; skipped when the client IP is unknown)"},
+		{"login.lockout", "ISUCONP_LOGIN_LOCKOUT", "login-lockout", false, &c.Login.Lockout, "how long a locked account or IP stays locked"},
+		{"login.window", "ISUCONP_LOGIN_WINDOW", "login-window", false, &c.Login.Window, "forget failed logins after this much time without failures"},
+		{"login.backoff_after", "ISUCONP_LOGIN_BACKOFF_AFTER", "login-backoff-after", false, &c.Login.BackoffAfter, "start delaying retries after this many failed logins"},
+		{"login.backoff_base", "ISUCONP_LOGIN_BACKOFF_BASE", "login-backoff-base", false, &c.Login.BackoffBase, "first retry delay, doubled on each further failure"},
+		{"login.backoff_max", "ISUCONP_LOGIN_BACKOFF_MAX", "login-backoff-max", false, &c.Login.BackoffMax, "maximum retry delay"},
+		{"rate_limit.post.rate", "ISUCONP_RATE_LIMIT_POST_RATE", "rate-limit-post-rate", false, &c.RateLimit.Post.Rate, "posts per second allowed per user (0 to disable)"},
+		{"rate_limit.post.burst", "ISUCONP_RATE_LIMIT_POST_BURST", "rate-limit-post-burst", false, &c.RateLimit.Post.Burst, "burst of posts allowed per user"},
+		{"rate_limit.post_ip.rate", "ISUCONP_RATE_LIMIT_POST_IP_RATE", "rate-limit-post-ip-rate", false, &c.RateLimit.PostIP.Rate, "posts per second allowed per client IP (0 to disable; skipped when the client IP is unknown)"},
+		{"rate_limit.post_ip.burst", "ISUCONP_RATE_LIMIT_POST_IP_BURST", "rate-limit-post-ip-burst", false, &c.RateLimit.PostIP.Burst, "burst of posts allowed per client IP"},
+		{"rate_limit.comment.rate", "ISUCONP_RATE_LIMIT_COMMENT_RATE", "rate-limit-comment-rate", false, &c.RateLimit.Comment.Rate, "comments per second allowed per user (0 to disable)"},
+		{"rate_limit.comment.burst", "ISUCONP_RATE_LIMIT_COMMENT_BURST", "rate-limit-comment-burst", false, &c.RateLimit.Comment.Burst, "burst of comments allowed per user"},
+		{"rate_limit.comment_ip.rate", "ISUCONP_RATE_LIMIT_COMMENT_IP_RATE", "rate-limit-comment-ip-rate", false, &c.RateLimit.CommentIP.Rate, "comments per second allowed per client IP (0 to disable; skipped when the client IP is unknown)"},
+		{"rate_limit.comment_ip.burst", "ISUCONP_RATE_LIMIT_COMMENT_IP_BURST", "rate-limit-comment-ip-burst", false, &c.RateLimit.CommentIP.Burst, "burst of comments allowed per client IP"},
+		{"ban.expire_interval", "ISUCONP_BAN_EXPIRE_INTERVAL", "ban-expire-interval", false, &c.Ban.ExpireInterval, "how often to lift expired bans"},
+		{"admin.listen", "ISUCONP_ADMIN_ADDRESS", "admin-listen", false, &c.Admin.Listen, "address of the admin listener (pprof, metrics)"},
+		{"admin.benchmark_mode", "ISUCONP_BENCHMARK_MODE", "benchmark-mode", false, &c.Admin.BenchmarkMode, "allow /initialize from anywhere for the benchmarker"},
+		{"admin.initialize_secret", "ISUCONP_INITIALIZE_SECRET", "initialize-secret", true, &c.Admin.InitializeSecret, "shared secret required by /initialize in the X-Initialize-Token header (403 when unset)"},
+		{"shutdown.timeout", "ISUCONP_SHUTDOWN_TIMEOUT", "shutdown-timeout", false, &c.Shutdown.Timeout, "how long to wait for in-flight requests on shutdown"},
+		{"shutdown.delay", "ISUCONP_SHUTDOWN_DELAY", "shutdown-delay", false, &c.Shutdown.Delay, "how long to fail /readyz before draining"},
+		{"db.host", "ISUCONP_DB_HOST", "db-host", false, &c.DB.Host, "MySQL host"},
+		{"db.port", "ISUCONP_DB_PORT", "db-port", false, &c.DB.Port, "MySQL port"},
+		{"db.user", "ISUCONP_DB_USER", "db-user", false, &c.DB.User, "MySQL user"},
+		{"db.password", "ISUCONP_DB_PASSWORD", "db-password", true, &c.DB.Password, "MySQL password"},
+		{"db.name", "ISUCONP_DB_NAME", "db-name", false, &c.DB.Name, "MySQL database name"},
+		{"db.max_open_conns", "ISUCONP_DB_MAX_OPEN_CONNS", "db-max-open-conns", false, &c.DB.MaxOpenConns, "maximum number of open connections (0 for unlimited)"},
+		{"db.max_idle_conns", "ISUCONP_DB_MAX_IDLE_CONNS", "db-max-idle-conns", false, &c.DB.MaxIdleConns, "maximum number of idle connections"},
+		{"db.conn_max_lifetime", "ISUCONP_DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", false, &c.DB.ConnMaxLifetime, "maximum lifetime of a connection (0 for no limit)"},
+		{"db.conn_max_idle_time", "ISUCONP_DB_CONN_MAX_IDLE_TIME", "db-conn-max-idle-time", false, &c.DB.ConnMaxIdleTime, "maximum idle time of a connection (0 for no limit)"},
+		{"db.interpolate_params", "ISUCONP_DB_INTERPOLATE_PARAMS", "db-interpolate-params", false, &c.DB.InterpolateParams, "interpolate placeholders on the client side"},
+		{"db.dial_timeout", "ISUCONP_DB_DIAL_TIMEOUT", "db-dial-timeout", false, &c.DB.DialTimeout, "timeout for establishing a connection"},
+		{"db.read_timeout", "ISUCONP_DB_READ_TIMEOUT", "db-read-timeout", false, &c.DB.ReadTimeout, "I/O read timeout (0 for none)"},
+		{"db.write_timeout", "ISUCONP_DB_WRITE_TIMEOUT", "db-write-timeout", false, &c.DB.WriteTimeout, "I/O write timeout (0 for none)"},
+		{"db.tls", "ISUCONP_DB_TLS", "db-tls", false, &c.DB.TLS, "TLS mode (true, false, skip-verify, preferred or empty)"},
+		{"db.connect_timeout", "ISUCONP_DB_CONNECT_TIMEOUT", "db-connect-timeout", false, &c.DB.ConnectTimeout, "how long to wait for MySQL on startup"},
+		{"db.replicas", "ISUCONP_DB_REPLICAS", "db-replicas", false, &c.DB.Replicas, "comma separated host:port list of read replicas"},
+		{"db.replica_check_interval", "ISUCONP_DB_REPLICA_CHECK_INTERVAL", "db-replica-check-interval", false, &c.DB.ReplicaCheckInterval, "how often to health check read replicas"},
+		{"memcached.address", "ISUCONP_MEMCACHED_ADDRESS", "memcached-address", false, &c.Memcached.Address, "memcached address"},
+		{"cache.local_size", "ISUCONP_CACHE_LOCAL_SIZE", "cache-local-size", false, &c.Cache.LocalSize, "number of entries in the in-process LRU cache"},
+		{"cache.local_ttl", "ISUCONP_CACHE_LOCAL_TTL", "cache-local-ttl", false, &c.Cache.LocalTTL, "TTL of the in-process LRU cache (0 to disable)"},
+		{"cache.comment_counts", "ISUCONP_CACHE_COMMENT_COUNTS", "cache-comment-counts", false, &c.Cache.CommentCounts, "also cache comment counts in memcached"},
+		{"cache.comments_soft_ttl", "ISUCONP_CACHE_COMMENTS_SOFT_TTL", "cache-comments-soft-ttl", false, &c.Cache.CommentsSoftTTL, "refresh cached comment lists in the background after this"},
+		{"cache.comments_hard_ttl", "ISUCONP_CACHE_COMMENTS_HARD_TTL", "cache-comments-hard-ttl", false, &c.Cache.CommentsHardTTL, "expire cached comment lists from memcached after this"},
+		{"cache.fragments", "ISUCONP_CACHE_FRAGMENTS", "cache-fragments", false, &c.Cache.Fragments, "cache rendered timeline posts (off, on or compare)"},
+		{"trace.exporter", "ISUCONP_TRACE_EXPORTER", "trace-exporter", false, &c.Trace.Exporter, "trace exporter (otlp, stdout or empty to disable)"},
+		{"trace.sample_ratio", "ISUCONP_TRACE_SAMPLE_RATIO", "trace-sample-ratio", false, &c.Trace.SampleRatio, "ratio of traces to sample (0-1)"},
+		{"slow_query.threshold", "ISUCONP_SLOW_QUERY_THRESHOLD", "slow-query-threshold", false, &c.SlowQuery.Threshold, "log queries slower than this (0 to disable)"},
+		{"slow_query.explain", "ISUCONP_SLOW_QUERY_EXPLAIN", "slow-query-explain", false, &c.SlowQuery.Explain, "run EXPLAIN once per slow statement"},
+	}
+}
+
+func (s setting) set(v string) error {
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*p = f
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *[]string:
+		*p = nil
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				*p = append(*p, e)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", s.ptr)
+	}
+	return nil
+}
+
+func (s setting) String() string {
+	switch p := s.ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *float64:
+		return strconv.FormatFloat(*p, 'g', -1, 64)
+	case *time.Duration:
+		return p.String()
+	case *[]string:
+		return strings.Join(*p, ",")
+	}
+	return ""
+}
+
+// 設定ファイル、環境変数、フラグの順に読み込んで検証する。
+// 設定ファイルのパスは-configフラグかISUCONP_CONFIGで指定する
+func loadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("ISUCONP_CONFIG"), "path to a YAML config file")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag, s.usage+" (env "+s.env+")", func(v string) error {
+			flagValues[s.flag] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *configPath != "" {
+		f, err := os.Open(*configPath)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil && err != io.EOF {
+			return c, fmt.Errorf("%s: %w", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(v); err != nil {
+				return c, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := s.set(v); err != nil {
+				return c, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	if c.Listen == "" {
+		errs = append(errs, "listen must not be empty")
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 {
+		errs = append(errs, "read_timeout and write_timeout must be positive")
+	}
+	if c.ImageDir == "" {
+		errs = append(errs, "image_dir must not be empty")
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Sprintf("trusted_proxies: %s", err))
+	}
+	switch c.Session.Backend {
+	case "cookie", "memcached":
+	case "redis":
+		if c.Session.Redis.Address == "" {
+			errs = append(errs, "session.redis.address must not be empty")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("session.backend %q must be cookie, memcached or redis", c.Session.Backend))
+	}
+	if len(c.Session.Secrets) == 0 {
+		errs = append(errs, "session.secrets must not be empty")
+	}
+	for _, secret := range c.Session.Secrets {
+		if secret == "" {
+			errs = append(errs, "session.secrets must not contain an empty secret")
+			break
+		}
+	}
+	switch c.Session.SameSite {
+	case "lax", "strict":
+	case "none":
+		// SameSite=NoneはSecureなしだとブラウザに捨てられる
+		if !c.Session.Secure {
+			errs = append(errs, "session.same_site none requires session.secure")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("session.same_site %q must be lax, strict or none", c.Session.SameSite))
+	}
+	if c.Session.MaxAge < time.Second {
+		errs = append(errs, "session.max_age must be at least 1s")
+	}
+	if c.Session.PurgeInterval <= 0 {
+		errs = append(errs, "session.purge_interval must be positive")
+	}
+	// memcachedの有効期限は30日を超えるとUNIX時刻として扱われてしまう
+	if c.Session.Backend == "memcached" && c.Session.MaxAge > 30*24*time.Hour {
+		errs = append(errs, "session.max_age must not exceed 720h with the memcached backend")
+	}
+	if c.Login.MaxFailures < 0 || c.Login.IPMaxFailures < 0 || c.Login.BackoffAfter < 0 {
+		errs = append(errs, "login.max_failures, login.ip_max_failures and login.backoff_after must not be negative")
+	}
+	if c.Login.Lockout <= 0 || c.Login.Window <= 0 {
+		errs = append(errs, "login.lockout and login.window must be positive")
+	}
+	if c.Login.BackoffBase < 0 || c.Login.BackoffMax < c.Login.BackoffBase {
+		errs = append(errs, "login.backoff_base must not be negative and must not exceed login.backoff_max")
+	}
+	for name, rule := range map[string]rateLimitRule{
+		"post": c.RateLimit.Post, "post_ip": c.RateLimit.PostIP,
+		"comment": c.RateLimit.Comment, "comment_ip": c.RateLimit.CommentIP,
+	} {
+		if rule.Rate < 0 || (rule.Rate > 0 && rule.Burst < 1) {
+			errs = append(errs, fmt.Sprintf("rate_limit.%s.rate must not be negative and rate_limit.%s.burst must be at least 1", name, name))
+		}
+	}
+	if c.Ban.ExpireInterval <= 0 {
+		errs = append(errs, "ban.expire_interval must be positive")
+	}
+	if c.Shutdown.Timeout <= 0 || c.Shutdown.Delay < 0 {
+		errs = append(errs, "shutdown.timeout must be positive and shutdown.delay must not be negative")
+	}
+	if c.DB.Port <= 0 || c.DB.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("db.port %d is out of range", c.DB.Port))
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 {
+		errs = append(errs, "db.max_open_conns and db.max_idle_conns must not be negative")
+	}
+	if c.DB.MaxOpenConns > 0 && c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		errs = append(errs, "db.max_idle_conns must not exceed db.max_open_conns")
+	}
+	switch c.DB.TLS {
+	case "", "true", "false", "skip-verify", "preferred":
+	default:
+		errs = append(errs, fmt.Sprintf("db.tls %q must be true, false, skip-verify, preferred or empty", c.DB.TLS))
+	}
+	if c.DB.ConnectTimeout <= 0 {
+		errs = append(errs, "db.connect_timeout must be positive")
+	}
+	for _, addr := range c.DB.Replicas {
+		if _, _, err := splitReplicaAddr(addr, c.DB.Port); err != nil {
+			errs = append(errs, fmt.Sprintf("db.replicas %q: %s", addr, err))
+		}
+	}
+	if len(c.DB.Replicas) > 0 && c.DB.ReplicaCheckInterval <= 0 {
+		errs = append(errs, "db.replica_check_interval must be positive")
+	}
+	if c.Memcached.Address == "" {
+		errs = append(errs, "memcached.address must not be empty")
+	}
+	if c.Cache.LocalSize < 0 || c.Cache.LocalTTL < 0 {
+		errs = append(errs, "cache.local_size and cache.local_ttl must not be negative")
+	}
+	if c.Cache.CommentsSoftTTL <= 0 || c.Cache.CommentsHardTTL < c.Cache.CommentsSoftTTL {
+		errs = append(errs, "cache.comments_soft_ttl must be positive and not exceed cache.comments_hard_ttl")
+	}
+	switch c.Cache.Fragments {
+	case "off", "on", "compare":
+	default:
+		errs = append(errs, fmt.Sprintf("cache.fragments %q must be off, on or compare", c.Cache.Fragments))
+	}
+	switch c.Trace.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Sprintf("trace.exporter %q must be otlp, stdout or empty", c.Trace.Exporter))
+	}
+	if c.Trace.SampleRatio < 0 || c.Trace.SampleRatio > 1 {
+		errs = append(errs, "trace.sample_ratio must be between 0 and 1")
+	}
+	if c.SlowQuery.Threshold < 0 {
+		errs = append(errs, "slow_query.threshold must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ./app config print で有効な設定値を表示する。シークレットは伏せる
+func printConfig(w io.Writer, c Config) {
+	for _, s := range c.settings() {
+		v := s.String()
+		if s.secret && v != "" {
+			v = "[REDACTED]"
+		}
+		fmt.Fprintf(w, "%s = %s\n", s.key, v)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// usersのpost_count、comment_count、commented_countと、postsのcomment_countは
+// 投稿やコメントと同じトランザクションで更新する
+
+func incrementPostCount(ctx context.Context, tx *Tx, userID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE `users` SET `post_count` = `post_count` + 1 WHERE `id` = ?", userID)
+	return err
+}
+
+// 投稿のcomment_count、コメントしたユーザーのcomment_count、投稿したユーザーのcommented_countを増やす
+func incrementCommentCounts(ctx context.Context, tx *Tx, postID, userID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE `posts` SET `comment_count` = `comment_count` + 1 WHERE `id` = ?", postID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE `users` SET `comment_count` = `comment_count` + 1 WHERE `id` = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE `users` JOIN `posts` ON posts.`user_id` = users.`id` "+
+			"SET users.`commented_count` = users.`commented_count` + 1 "+
+			"WHERE posts.`id` = ?", postID)
+	return err
+}
+
+// 投稿やコメントのテーブルから数え直してカウンタを作り直す。
+// /initializeで行を消したあとや、カウンタがずれたときに使う
+func reconcileCounters(ctx context.Context) (int64, error) {
+	postResult, err := db.ExecContext(ctx,
+		"UPDATE `posts` AS p "+
+			"LEFT JOIN (SELECT `post_id`, COUNT(*) AS c FROM `comments` GROUP BY `post_id`) AS c ON c.`post_id` = p.`id` "+
+			"SET p.`comment_count` = COALESCE(c.c, 0)")
+	if err != nil {
+		return 0, err
+	}
+	postRows, err := postResult.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	userResult, err := db.ExecContext(ctx,
+		"UPDATE `users` AS u "+
+			"LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `posts` GROUP BY `user_id`) AS p ON p.`user_id` = u.`id` "+
+			"LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `comments` GROUP BY `user_id`) AS c ON c.`user_id` = u.`id` "+
+			"LEFT JOIN (SELECT posts.`user_id`, COUNT(*) AS c FROM `comments` JOIN `posts` ON posts.`id` = comments.`post_id` GROUP BY posts.`user_id`) AS cd ON cd.`user_id` = u.`id` "+
+			"SET u.`post_count` = COALESCE(p.c, 0), u.`comment_count` = COALESCE(c.c, 0), u.`commented_count` = COALESCE(cd.c, 0)")
+	if err != nil {
+		return 0, err
+	}
+	userRows, err := userResult.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return postRows + userRows, nil
+}
+
+// ./app reconcile [flags]
+func runReconcile(ctx context.Context, w io.Writer, args []string) error {
+	if err := setupCommand(ctx, args); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	n, err := reconcileCounters(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "reconciled counters (%d rows changed)\n", n)
+	return nil
+}
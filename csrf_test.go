@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// csrf_tokenを入れたセッションのCookieを返す。tokenが空ならトークンのないセッションにする
+func csrfSessionCookie(t *testing.T, token string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session := getSession(r)
+	if token != "" {
+		session.Values["csrf_token"] = token
+	}
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestCSRFProtect(t *testing.T) {
+	defer func(savedConfig Config, savedStore sessions.Store) {
+		config, store = savedConfig, savedStore
+	}(config, store)
+	config = defaultConfig()
+	config.Session.Backend = "cookie"
+	var err error
+	if store, err = newSessionStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		session string
+		form    string
+		header  string
+		code    int
+	}{
+		{"get without token", "GET", "", "", "", http.StatusOK},
+		{"form token", "POST", "token", "token", "", http.StatusOK},
+		{"header token", "POST", "token", "", "token", http.StatusOK},
+		{"header takes precedence over form", "POST", "token", "token", "wrong", http.StatusUnprocessableEntity},
+		{"wrong form token", "POST", "token", "wrong", "", http.StatusUnprocessableEntity},
+		{"empty form token", "POST", "token", "", "", http.StatusUnprocessableEntity},
+		{"empty session token", "POST", "", "", "", http.StatusUnprocessableEntity},
+		{"empty session token with a token", "POST", "", "token", "", http.StatusUnprocessableEntity},
+	}
+	h := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set("csrf_token", tt.form)
+			}
+			r := httptest.NewRequest(tt.method, "/comment", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			r.AddCookie(csrfSessionCookie(t, tt.session))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
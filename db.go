@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sqlx.DBのラッパー。クエリごとにspanを作るので、ハンドラからはContext付きのメソッドを使う
+type DB struct {
+	*sqlx.DB
+}
+
+func (d *DB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, "sql.get", query, args, func(ctx context.Context) error {
+		return d.DB.GetContext(ctx, dest, query, args...)
+	})
+}
+
+func (d *DB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, "sql.select", query, args, func(ctx context.Context) error {
+		return d.DB.SelectContext(ctx, dest, query, args...)
+	})
+}
+
+func (d *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := observeQuery(ctx, "sql.exec", query, args, func(ctx context.Context) error {
+		var err error
+		result, err = d.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// トランザクションもDBと同じくクエリごとにspanを作る
+type Tx struct {
+	*sqlx.Tx
+}
+
+func (t *Tx) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, "sql.get", query, args, func(ctx context.Context) error {
+		return t.Tx.GetContext(ctx, dest, query, args...)
+	})
+}
+
+func (t *Tx) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return observeQuery(ctx, "sql.select", query, args, func(ctx context.Context) error {
+		return t.Tx.SelectContext(ctx, dest, query, args...)
+	})
+}
+
+func (t *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := observeQuery(ctx, "sql.exec", query, args, func(ctx context.Context) error {
+		var err error
+		result, err = t.Tx.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// fnをトランザクション内で実行する。fnがエラーを返したらロールバックする
+func (d *DB) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	tx, err := d.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(&Tx{tx}); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			log.Print(rerr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// db.*の設定からDSNを組み立てる
+func mysqlDSN(host string, port int) string {
+	c := mysql.NewConfig()
+	c.User = config.DB.User
+	c.Passwd = config.DB.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	c.DBName = config.DB.Name
+	c.Params = map[string]string{"charset": "utf8mb4"}
+	c.ParseTime = true
+	c.Loc = time.Local
+	c.InterpolateParams = config.DB.InterpolateParams
+	c.Timeout = config.DB.DialTimeout
+	c.ReadTimeout = config.DB.ReadTimeout
+	c.WriteTimeout = config.DB.WriteTimeout
+	c.TLSConfig = config.DB.TLS
+	return c.FormatDSN()
+}
+
+// コネクションプールを設定したDBを作る。sqlx.Openと同じく接続はまだしない
+func newDB(host string, port int) (*DB, error) {
+	dbx, err := sqlx.Open("mysql", mysqlDSN(host, port))
+	if err != nil {
+		return nil, err
+	}
+	dbx.SetMaxOpenConns(config.DB.MaxOpenConns)
+	dbx.SetMaxIdleConns(config.DB.MaxIdleConns)
+	dbx.SetConnMaxLifetime(config.DB.ConnMaxLifetime)
+	dbx.SetConnMaxIdleTime(config.DB.ConnMaxIdleTime)
+	return &DB{dbx}, nil
+}
+
+// コネクションプールを設定して、MySQLが応答するまでバックオフしながら待つ。
+// docker composeなどでアプリが先に起動しても、最初のクエリで落ちないようにする
+func openDB(ctx context.Context, host string, port int) (*DB, error) {
+	d, err := newDB(host, port)
+	if err != nil {
+		return nil, err
+	}
+	dbx := d.DB
+
+	ctx, cancel := context.WithTimeout(ctx, config.DB.ConnectTimeout)
+	defer cancel()
+
+	backoff := 100 * time.Millisecond
+	for {
+		err = dbx.PingContext(ctx)
+		if err == nil {
+			return &DB{dbx}, nil
+		}
+		log.Printf("waiting for MySQL at %s:%d: %s", host, port, err)
+
+		select {
+		case <-ctx.Done():
+			dbx.Close()
+			return nil, fmt.Errorf("gave up connecting to MySQL at %s:%d: %w", host, port, err)
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// spanを作りつつ、スロークエリログ用に実行時間を集計する
+func observeQuery(ctx context.Context, name, query string, args []interface{}, fn func(context.Context) error) error {
+	ctx, span := startSpan(ctx, name,
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.statement", query),
+	)
+	start := time.Now()
+	err := fn(ctx)
+	queryStats.record(query, args, time.Since(start))
+	if err == sql.ErrNoRows {
+		// 行がないのは正常系なのでエラー扱いにしない
+		endSpan(span, nil)
+		return err
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 読み込み専用クエリをレプリカにラウンドロビンで振り分ける。
+// 書き込みと、書いた直後に読む処理はプライマリ(db)に投げる
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint32
+}
+
+type replica struct {
+	addr    string
+	db      *DB
+	healthy atomic.Bool
+}
+
+var replicas = &replicaSet{}
+
+type primaryOnlyKey struct{}
+
+// レプリカの遅延で書いたばかりのデータが見えないと困る処理では、これを通したctxを使う
+func withPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryOnlyKey{}, true)
+}
+
+// 読み込み用のDBを返す。健全なレプリカがなければプライマリを返す
+func readDB(ctx context.Context) *DB {
+	if ctx.Value(primaryOnlyKey{}) != nil {
+		return db
+	}
+
+	n := len(replicas.replicas)
+	if n == 0 {
+		return db
+	}
+	start := int(replicas.next.Add(1))
+	for i := 0; i < n; i++ {
+		r := replicas.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return db
+}
+
+// host:port(ポートは省略可)を分解する
+func splitReplicaAddr(addr string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// ポートが省略されている
+		return addr, defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// db.replicasのレプリカに接続する。起動時に落ちているレプリカは不健全扱いにしておき、
+// ヘルスチェックで復帰したら振り分け先に戻す
+func openReplicas(ctx context.Context) (*replicaSet, error) {
+	rs := &replicaSet{}
+	for _, addr := range config.DB.Replicas {
+		host, port, err := splitReplicaAddr(addr, config.DB.Port)
+		if err != nil {
+			return nil, err
+		}
+		d, err := newDB(host, port)
+		if err != nil {
+			return nil, err
+		}
+		rs.replicas = append(rs.replicas, &replica{addr: addr, db: d})
+	}
+	rs.check(ctx)
+	return rs, nil
+}
+
+func (rs *replicaSet) check(ctx context.Context) {
+	for _, r := range rs.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Printf("replica %s is healthy", r.addr)
+			} else {
+				log.Printf("replica %s is unhealthy: %s", r.addr, err)
+			}
+		}
+	}
+}
+
+// ctxがキャンセルされるまで定期的にレプリカをヘルスチェックする
+func (rs *replicaSet) watch(ctx context.Context, interval time.Duration) {
+	if len(rs.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rs.check(ctx)
+		}
+	}
+}
+
+func (rs *replicaSet) Close() error {
+	var firstErr error
+	for _, r := range rs.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// タイムラインの投稿1件ぶんのHTMLをmemcachedにキャッシュする。
+// コメントが増えるとposts.comment_countが変わるので、それをバージョンとしてキーに含める。
+// CSRFトークンはユーザーごとに違うので、プレースホルダのままキャッシュして配信時に差し込む。
+// 本文やコメントに同じ文字列を書かれても差し込まないように、post.htmlのhidden inputごと置き換える
+const fragmentCSRFPlaceholder = "__ISUCONP_CSRF_TOKEN__"
+
+func csrfInput(token string) string {
+	return `<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(token) + `">`
+}
+
+// 断片はキャッシュしたコメント一覧から作るので、コメント一覧のソフトTTL(cache.comments_soft_ttl)より長くは持たない。
+// /initializeでcomment_countが巻き戻ったときも、同じキーの古い断片はすぐに消える
+func fragmentExpiration() int32 {
+	sec := int32(config.Cache.CommentsSoftTTL / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+func fragmentKey(p Post) string {
+	return "fragment.index." + strconv.Itoa(p.ID) + "." + strconv.Itoa(p.CommentCount)
+}
+
+// 投稿一覧(posts.html)をレンダリングする。cache.fragmentsがoffなら毎回テンプレートを実行し、
+// onならキャッシュした断片を組み立て、compareなら両方作って食い違いをログに出す(返すのはキャッシュなしのほう)
+func renderIndexPosts(ctx context.Context, results []Post, csrfToken string) (template.HTML, error) {
+	switch config.Cache.Fragments {
+	case "on":
+		return renderPostsFromFragments(ctx, results, csrfToken)
+	case "compare":
+		uncached, err := renderPosts(ctx, results, csrfToken)
+		if err != nil {
+			return "", err
+		}
+		cached, err := renderPostsFromFragments(ctx, results, csrfToken)
+		if err != nil {
+			log.Print(err)
+		} else if cached != uncached {
+			log.Printf("fragment cache mismatch for posts %v", postIDs(results))
+		}
+		return uncached, nil
+	default:
+		return renderPosts(ctx, results, csrfToken)
+	}
+}
+
+func renderPosts(ctx context.Context, results []Post, csrfToken string) (template.HTML, error) {
+	posts, err := makePosts(ctx, results, csrfToken, false)
+	if err != nil {
+		return "", err
+	}
+
+	fmap := template.FuncMap{
+		"imageURL": imageURL,
+	}
+
+	var buf bytes.Buffer
+	err = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(&buf, posts)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func renderPostsFromFragments(ctx context.Context, results []Post, csrfToken string) (template.HTML, error) {
+	keys := make([]string, 0, len(results))
+	for _, p := range results {
+		keys = append(keys, fragmentKey(p))
+	}
+	items, err := appCache.GetMulti(ctx, keys)
+	if err != nil {
+		return "", err
+	}
+
+	// キャッシュになかった投稿だけまとめてmakePostsしてレンダリングする
+	var misses []Post
+	missKeys := map[int]string{}
+	for _, p := range results {
+		if _, ok := items[fragmentKey(p)]; !ok {
+			misses = append(misses, p)
+			missKeys[p.ID] = fragmentKey(p)
+		}
+	}
+	if len(misses) > 0 {
+		posts, err := makePosts(ctx, misses, fragmentCSRFPlaceholder, false)
+		if err != nil {
+			return "", err
+		}
+
+		fmap := template.FuncMap{
+			"imageURL": imageURL,
+		}
+		tmpl := template.Must(template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html")))
+		for _, p := range posts {
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, p); err != nil {
+				return "", err
+			}
+			// cache.comment_countsがonだとmakePostsがCommentCountをmemcachedの値に変えることがあるので、
+			// 引く側と同じく元の投稿のキーで保存する
+			item := &memcache.Item{Key: missKeys[p.ID], Value: buf.Bytes(), Expiration: fragmentExpiration()}
+			if err := appCache.Set(ctx, item); err != nil {
+				return "", err
+			}
+			items[item.Key] = item
+		}
+	}
+
+	fragments := make([]template.HTML, 0, len(results))
+	for _, p := range results {
+		item, ok := items[fragmentKey(p)]
+		if !ok {
+			// makePostsが返さなかった投稿。キャッシュなしの経路と同じく表示しない
+			continue
+		}
+		html := strings.ReplaceAll(string(item.Value), csrfInput(fragmentCSRFPlaceholder), csrfInput(csrfToken))
+		fragments = append(fragments, template.HTML(html))
+	}
+
+	// posts.htmlの空白まで同じにするため、post.htmlだけ断片をそのまま出すテンプレートに差し替える
+	var buf bytes.Buffer
+	tmpl := template.Must(template.New("posts.html").ParseFiles(getTemplPath("posts.html")))
+	template.Must(tmpl.New("post.html").Parse("{{ . }}"))
+	if err := tmpl.ExecuteTemplate(&buf, "posts.html", fragments); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// userIDsの投稿の断片とコメント一覧のキャッシュを消す。BANしたユーザーの投稿がキャッシュから出ないようにする
+func invalidateUserPostCaches(ctx context.Context, userIDs []int) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT `id`, `comment_count` FROM `posts` WHERE `user_id` IN (?)", userIDs)
+	if err != nil {
+		return err
+	}
+	var posts []Post
+	if err := db.SelectContext(ctx, &posts, query, args...); err != nil {
+		return err
+	}
+
+	for _, p := range posts {
+		for _, key := range []string{fragmentKey(p), commentsCacheKey(p.ID, p.CommentCount, false), commentsCacheKey(p.ID, p.CommentCount, true)} {
+			if err := appCache.Delete(ctx, key); err != nil && err != memcache.ErrCacheMiss {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func postIDs(posts []Post) []int {
+	ids := make([]int, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SIGTERMを受け取ったらtrueにする。/readyzを失敗させてロードバランサーに振り分けを止めてもらう
+var shuttingDown atomic.Bool
+
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+// プロセスが生きていれば200を返す。依存先は見ない
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// MySQL、memcached、画像ディレクトリ(セッションがredisならRedisも)を確認して、全部使えるときだけ200を返す
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "shutting_down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res := healthResponse{Status: "ok", Components: map[string]componentStatus{}}
+	checks := map[string]func(context.Context) error{
+		"mysql":     db.PingContext,
+		"memcached": func(context.Context) error { return memcacheClient.Ping() },
+		"image_dir": checkImageDirWritable,
+	}
+	if rs, ok := store.(*redisStore); ok {
+		checks["redis"] = rs.Ping
+	}
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			res.Status = "fail"
+			res.Components[name] = componentStatus{Status: "fail", Error: err.Error()}
+			continue
+		}
+		res.Components[name] = componentStatus{Status: "ok"}
+	}
+
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, res)
+}
+
+// 投稿画像を書き込めるかどうかを、実際に一時ファイルを作って確認する
+func checkImageDirWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(config.ImageDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func writeHealth(w http.ResponseWriter, status int, res healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
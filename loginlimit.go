@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ログインの失敗回数をアカウント名ごととクライアントのIPごとにmemcachedで数える。
+//   - アカウント名: login.backoff_after回目の失敗から、失敗するたびに待ち時間を倍にする。
+//     login.max_failures回失敗したらlogin.lockoutのあいだロックする
+//   - IP: login.ip_max_failures回失敗したらlogin.lockoutのあいだロックする。
+//     本当のクライアントのIPがわからないとき(ipが空)は、全員が同じキーになってしまうので数えない
+//
+// 失敗の記録は最後の失敗からlogin.windowで消える。ログインに成功したらアカウント名の記録だけ消す
+type loginFailures struct {
+	Count       int       `json:"count"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// memcachedのキーに使えない文字が入っていても大丈夫なように、アカウント名はハッシュにする
+func loginAccountKey(accountName string) string {
+	sum := sha256.Sum256([]byte(accountName))
+	return "login_failures.account." + hex.EncodeToString(sum[:])
+}
+
+func loginIPKey(ip string) string {
+	return "login_failures.ip." + ip
+}
+
+func loginLimitEnabled() bool {
+	return config.Login.MaxFailures > 0 || config.Login.IPMaxFailures > 0
+}
+
+// アカウント名とIPのどちらかが待ち時間中なら、解けるまでの時間と、ロックされているかどうかを返す
+func loginLockedFor(ctx context.Context, accountName, ip string) (time.Duration, bool) {
+	if !loginLimitEnabled() {
+		return 0, false
+	}
+
+	accountKey, ipKey := loginAccountKey(accountName), ""
+	keys := []string{accountKey}
+	if ip != "" {
+		ipKey = loginIPKey(ip)
+		keys = append(keys, ipKey)
+	}
+	items, err := memcacheClient.GetMulti(ctx, keys)
+	if err != nil {
+		// memcachedが落ちていてもログインはできるようにしておく
+		log.Print(err)
+		return 0, false
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	locked := false
+	for key, item := range items {
+		var lf loginFailures
+		if err := json.Unmarshal(item.Value, &lf); err != nil {
+			continue
+		}
+		d := lf.LockedUntil.Sub(now)
+		if d <= 0 {
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
+		max := config.Login.MaxFailures
+		if key == ipKey {
+			max = config.Login.IPMaxFailures
+		}
+		if max > 0 && lf.Count >= max {
+			locked = true
+		}
+	}
+	return wait, locked
+}
+
+// 失敗を記録し、アカウント名とIPのうち長いほうの待ち時間と、ロックされたかどうかを返す
+func recordLoginFailure(ctx context.Context, accountName, ip string) (time.Duration, bool) {
+	if !loginLimitEnabled() {
+		return 0, false
+	}
+
+	now := time.Now()
+	account := updateLoginFailures(ctx, loginAccountKey(accountName), func(lf *loginFailures) {
+		switch {
+		case config.Login.MaxFailures > 0 && lf.Count >= config.Login.MaxFailures:
+			lf.LockedUntil = now.Add(config.Login.Lockout)
+		case lf.Count >= config.Login.BackoffAfter:
+			backoff := config.Login.BackoffMax
+			if shift := lf.Count - config.Login.BackoffAfter; shift < 32 {
+				if d := config.Login.BackoffBase << shift; d < backoff {
+					backoff = d
+				}
+			}
+			lf.LockedUntil = now.Add(backoff)
+		}
+	})
+	var byIP loginFailures
+	if ip != "" {
+		byIP = updateLoginFailures(ctx, loginIPKey(ip), func(lf *loginFailures) {
+			if config.Login.IPMaxFailures > 0 && lf.Count >= config.Login.IPMaxFailures {
+				lf.LockedUntil = now.Add(config.Login.Lockout)
+			}
+		})
+	}
+
+	wait := account.LockedUntil.Sub(now)
+	if d := byIP.LockedUntil.Sub(now); d > wait {
+		wait = d
+	}
+	locked := (config.Login.MaxFailures > 0 && account.Count >= config.Login.MaxFailures) ||
+		(config.Login.IPMaxFailures > 0 && byIP.Count >= config.Login.IPMaxFailures)
+	return wait, locked
+}
+
+// 失敗回数を1つ増やしてからlockで待ち時間を決める
+func updateLoginFailures(ctx context.Context, key string, lock func(*loginFailures)) loginFailures {
+	var lf loginFailures
+	err := memcacheClient.Update(ctx, key, func(value []byte) ([]byte, int32) {
+		lf = loginFailures{}
+		if value != nil {
+			json.Unmarshal(value, &lf)
+		}
+		lf.Count++
+		lock(&lf)
+
+		// ロックが解けるまでは記録を消さない
+		ttl := config.Login.Window
+		if d := time.Until(lf.LockedUntil); d > ttl {
+			ttl = d
+		}
+		b, _ := json.Marshal(lf)
+		return b, int32(ttl/time.Second) + 1
+	})
+	if err != nil {
+		log.Print(err)
+	}
+	return lf
+}
+
+func resetLoginFailures(ctx context.Context, accountName string) {
+	if !loginLimitEnabled() {
+		return
+	}
+	err := memcacheClient.Delete(ctx, loginAccountKey(accountName))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+}
+
+// ロック中であることを伝えるフラッシュメッセージ
+func loginLockedNotice(wait time.Duration, locked bool) string {
+	if locked {
+		return fmt.Sprintf("ログインの失敗が続いたため、ログインを一時的にロックしています。%s後にもう一度お試しください", formatWait(wait))
+	}
+	return fmt.Sprintf("ログインの失敗が続いています。%s後にもう一度お試しください", formatWait(wait))
+}
+
+// 待ち時間を切り上げて「3分」「10秒」のようにする
+func formatWait(d time.Duration) string {
+	if d > time.Minute {
+		return fmt.Sprintf("%d分", (d+time.Minute-1)/time.Minute)
+	}
+	return fmt.Sprintf("%d秒", (d+time.Second-1)/time.Second)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// memcache.Clientのラッパー。呼び出しごとにspanを作る
+type tracedMemcache struct {
+	*memcache.Client
+}
+
+func (c *tracedMemcache) Get(ctx context.Context, key string) (*memcache.Item, error) {
+	_, span := startSpan(ctx, "memcache.get", attribute.String("memcache.key", key))
+	item, err := c.Client.Get(key)
+	endSpan(span, ignoreCacheMiss(err))
+	return item, err
+}
+
+func (c *tracedMemcache) GetMulti(ctx context.Context, keys []string) (map[string]*memcache.Item, error) {
+	_, span := startSpan(ctx, "memcache.get_multi",
+		attribute.String("memcache.keys", strings.Join(keys, " ")),
+		attribute.Int("memcache.key_count", len(keys)),
+	)
+	items, err := c.Client.GetMulti(keys)
+	if err == nil {
+		span.SetAttributes(attribute.Int("memcache.hit_count", len(items)))
+	}
+	endSpan(span, err)
+	return items, err
+}
+
+func (c *tracedMemcache) Set(ctx context.Context, item *memcache.Item) error {
+	_, span := startSpan(ctx, "memcache.set", attribute.String("memcache.key", item.Key))
+	err := c.Client.Set(item)
+	endSpan(span, err)
+	return err
+}
+
+func (c *tracedMemcache) Delete(ctx context.Context, key string) error {
+	_, span := startSpan(ctx, "memcache.delete", attribute.String("memcache.key", key))
+	err := c.Client.Delete(key)
+	endSpan(span, ignoreCacheMiss(err))
+	return err
+}
+
+func (c *tracedMemcache) FlushAll(ctx context.Context) error {
+	_, span := startSpan(ctx, "memcache.flush_all")
+	err := c.Client.FlushAll()
+	endSpan(span, err)
+	return err
+}
+
+// 更新の競合が続いてUpdateを諦めたときのエラー
+var errUpdateConflict = errors.New("memcache: too many conflicting updates")
+
+// keyの値をupdateで書き換える。ほかのインスタンスと同時に書き換えたときはCASで検出して読み直す。
+// keyがなければupdateにnilを渡し、返した値をAddする。updateは値と有効期限(秒)を返す
+func (c *tracedMemcache) Update(ctx context.Context, key string, update func(value []byte) ([]byte, int32)) error {
+	_, span := startSpan(ctx, "memcache.update", attribute.String("memcache.key", key))
+	for i := 0; i < 5; i++ {
+		item, err := c.Client.Get(key)
+		if err == memcache.ErrCacheMiss {
+			value, expiration := update(nil)
+			err = c.Client.Add(&memcache.Item{Key: key, Value: value, Expiration: expiration})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			endSpan(span, err)
+			return err
+		}
+		if err != nil {
+			endSpan(span, err)
+			return err
+		}
+
+		item.Value, item.Expiration = update(item.Value)
+		err = c.Client.CompareAndSwap(item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		endSpan(span, err)
+		return err
+	}
+	endSpan(span, errUpdateConflict)
+	return errUpdateConflict
+}
+
+func ignoreCacheMiss(err error) error {
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations/NNNN_name.up.sql と NNNN_name.down.sql の組でスキーマを管理する。
+// 適用済みのバージョンはschema_migrationsテーブルに記録する
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		base := path.Base(f)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("%s: migration file must end with .up.sql or .down.sql", f)
+		}
+		name := strings.TrimSuffix(base, "."+direction+".sql")
+		versionStr, label, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("%s: migration file must be named NNNN_name", f)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+
+		body, err := migrationFS.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// 行末の;で文を区切る。コメントしかない塊は捨てる
+func splitStatements(sql string) []string {
+	var stmts []string
+	var b strings.Builder
+	hasBody := false
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			hasBody = true
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			if hasBody {
+				stmts = append(stmts, strings.TrimSpace(b.String()))
+			}
+			b.Reset()
+			hasBody = false
+		}
+	}
+	if hasBody {
+		stmts = append(stmts, strings.TrimSpace(b.String()))
+	}
+	return stmts
+}
+
+func ensureMigrationsTable(ctx context.Context) error {
+	_, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS `schema_migrations` ("+
+			"`version` int NOT NULL PRIMARY KEY, "+
+			"`name` varchar(255) NOT NULL, "+
+			"`applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP"+
+			") DEFAULT CHARSET=utf8mb4")
+	return err
+}
+
+func appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	err := db.SelectContext(ctx, &rows, "SELECT `version`, `applied_at` FROM `schema_migrations`")
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// 未適用のマイグレーションを古い順にすべて適用する。
+// MySQLのDDLは暗黙にコミットされるのでトランザクションにはしない
+func migrateUp(ctx context.Context, w io.Writer) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		fmt.Fprintf(w, "applying %04d_%s\n", m.Version, m.Name)
+		for _, stmt := range splitStatements(m.Up) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%04d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		_, err := db.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`, `name`) VALUES (?, ?)", m.Version, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 適用済みのマイグレーションを新しい順にsteps個戻す
+func migrateDown(ctx context.Context, w io.Writer, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		fmt.Fprintf(w, "reverting %04d_%s\n", m.Version, m.Name)
+		for _, stmt := range splitStatements(m.Down) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%04d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		_, err := db.ExecContext(ctx, "DELETE FROM `schema_migrations` WHERE `version` = ?", m.Version)
+		if err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+func migrateStatus(ctx context.Context, w io.Writer) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		status := "pending"
+		if at, ok := applied[m.Version]; ok {
+			status = "applied at " + at.Format(ISO8601Format)
+		}
+		fmt.Fprintf(w, "%04d_%s\t%s\n", m.Version, m.Name, status)
+	}
+	return nil
+}
+
+// ./app migrate [up|down [N]|status] [flags]
+func runMigrate(ctx context.Context, w io.Writer, args []string) error {
+	action := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	// DBにつなぐ前に確かめて、打ち間違いでdb.connect_timeoutまで待たせない
+	switch action {
+	case "up", "down", "status":
+	default:
+		return fmt.Errorf("unknown migrate action %q (up, down or status)", action)
+	}
+	steps := 1
+	if action == "down" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of steps %q", args[0])
+		}
+		steps, args = n, args[1:]
+	}
+
+	if err := setupCommand(ctx, args); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		return migrateUp(ctx, w)
+	case "down":
+		return migrateDown(ctx, w, steps)
+	default:
+		return migrateStatus(ctx, w)
+	}
+}
@@ -0,0 +1,2 @@
+-- users、posts、commentsは初期データとして既にあるテーブルをCREATE TABLE IF NOT EXISTSで引き継いでいるので、
+-- 戻しても消さない(このアプリが作ったのではないデータを消さないように、何もしない)
@@ -0,0 +1,4 @@
+ALTER TABLE `comments` DROP INDEX `idx_user_id`;
+ALTER TABLE `posts` DROP INDEX `idx_user_id_created_at`;
+ALTER TABLE `posts` DROP INDEX `idx_created_at`;
+ALTER TABLE `comments` DROP INDEX `idx_post_id_created_at`;
@@ -0,0 +1,8 @@
+-- makePostsのコメント取得 (WHERE post_id = ? ORDER BY created_at DESC)
+ALTER TABLE `comments` ADD INDEX `idx_post_id_created_at` (`post_id`, `created_at`);
+-- getIndex / getPostsのタイムライン (ORDER BY created_at DESC)
+ALTER TABLE `posts` ADD INDEX `idx_created_at` (`created_at`);
+-- getAccountNameのユーザーごとの投稿一覧
+ALTER TABLE `posts` ADD INDEX `idx_user_id_created_at` (`user_id`, `created_at`);
+-- getAccountNameのコメント数
+ALTER TABLE `comments` ADD INDEX `idx_user_id` (`user_id`);
@@ -0,0 +1,4 @@
+ALTER TABLE `users`
+  DROP COLUMN `commented_count`,
+  DROP COLUMN `comment_count`,
+  DROP COLUMN `post_count`;
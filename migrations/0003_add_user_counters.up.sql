@@ -0,0 +1,11 @@
+-- getAccountNameで毎回数えていた投稿数、コメント数、被コメント数を持たせる
+ALTER TABLE `users`
+  ADD COLUMN `post_count` int NOT NULL DEFAULT 0,
+  ADD COLUMN `comment_count` int NOT NULL DEFAULT 0,
+  ADD COLUMN `commented_count` int NOT NULL DEFAULT 0;
+
+UPDATE `users` AS u
+  LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `posts` GROUP BY `user_id`) AS p ON p.`user_id` = u.`id`
+  LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `comments` GROUP BY `user_id`) AS c ON c.`user_id` = u.`id`
+  LEFT JOIN (SELECT posts.`user_id`, COUNT(*) AS c FROM `comments` JOIN `posts` ON posts.`id` = comments.`post_id` GROUP BY posts.`user_id`) AS cd ON cd.`user_id` = u.`id`
+SET u.`post_count` = COALESCE(p.c, 0), u.`comment_count` = COALESCE(c.c, 0), u.`commented_count` = COALESCE(cd.c, 0);
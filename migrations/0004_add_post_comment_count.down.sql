@@ -0,0 +1 @@
+ALTER TABLE `posts` DROP COLUMN `comment_count`;
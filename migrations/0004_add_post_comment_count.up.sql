@@ -0,0 +1,6 @@
+-- makePostsで投稿ごとに数えていたコメント数を持たせる
+ALTER TABLE `posts` ADD COLUMN `comment_count` int NOT NULL DEFAULT 0;
+
+UPDATE `posts` AS p
+  LEFT JOIN (SELECT `post_id`, COUNT(*) AS c FROM `comments` GROUP BY `post_id`) AS c ON c.`post_id` = p.`id`
+SET p.`comment_count` = COALESCE(c.c, 0);
@@ -0,0 +1,9 @@
+-- ログイン中のセッションの一覧。すべての端末からのログアウトやBANのときにまとめて消す
+CREATE TABLE `user_sessions` (
+  `id` varchar(64) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `ip_address` varchar(64) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`)
+) DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,6 @@
+ALTER TABLE `users` ADD COLUMN `authority` tinyint(1) NOT NULL DEFAULT 0 AFTER `passhash`;
+
+-- moderatorは一般ユーザーに戻る
+UPDATE `users` SET `authority` = 1 WHERE `role` = 'admin';
+
+ALTER TABLE `users` DROP COLUMN `role`;
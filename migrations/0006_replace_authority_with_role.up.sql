@@ -0,0 +1,6 @@
+-- 0/1のauthorityを、user、moderator、adminの名前付きのロールに置き換える
+ALTER TABLE `users` ADD COLUMN `role` varchar(16) NOT NULL DEFAULT 'user' AFTER `passhash`;
+
+UPDATE `users` SET `role` = 'admin' WHERE `authority` = 1;
+
+ALTER TABLE `users` DROP COLUMN `authority`;
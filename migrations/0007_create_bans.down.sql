@@ -0,0 +1,3 @@
+DROP TABLE `moderation_logs`;
+
+DROP TABLE `bans`;
@@ -0,0 +1,23 @@
+-- BANの記録。users.del_flgが今BANされているかどうかで、こちらは誰がなぜいつまでBANしたか
+CREATE TABLE `bans` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `moderator_id` int NOT NULL,
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `started_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `expires_at` timestamp NULL DEFAULT NULL,
+  `lifted_at` timestamp NULL DEFAULT NULL,
+  `lifted_by` int DEFAULT NULL,
+  KEY `idx_user_id` (`user_id`),
+  KEY `idx_lifted_at_expires_at` (`lifted_at`, `expires_at`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- BAN、BAN解除、ロールの変更などモデレーションの操作の記録。moderator_idが0なら自動で行ったもの
+CREATE TABLE `moderation_logs` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `moderator_id` int NOT NULL,
+  `action` varchar(32) NOT NULL,
+  `target_user_id` int NOT NULL,
+  `detail` varchar(255) NOT NULL DEFAULT '',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4;
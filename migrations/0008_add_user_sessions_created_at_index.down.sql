@@ -0,0 +1 @@
+ALTER TABLE `user_sessions` DROP INDEX `idx_created_at`;
@@ -0,0 +1,2 @@
+-- purgeUserSessionsの期限切れのセッションの削除 (WHERE created_at <= ?)
+ALTER TABLE `user_sessions` ADD INDEX `idx_created_at` (`created_at`);
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var queryStats = &queryStatsCollector{stats: map[string]*queryStat{}}
+
+type queryStat struct {
+	Statement string
+	Count     int
+	Slow      int
+	Total     time.Duration
+	Max       time.Duration
+	Plan      string
+}
+
+type queryStatsCollector struct {
+	mu    sync.Mutex
+	stats map[string]*queryStat
+}
+
+// IN (?, ?, ...) のようにプレースホルダの数だけ違うクエリは同じステートメントとして集計する
+var placeholderListRegexp = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+
+func normalizeQuery(query string) string {
+	return placeholderListRegexp.ReplaceAllString(query, "?, ...")
+}
+
+func (c *queryStatsCollector) record(query string, args []interface{}, elapsed time.Duration) {
+	stmt := normalizeQuery(query)
+	// slow_query.thresholdより遅いクエリを引数付きでログに出す。0ならログに出さない
+	threshold := config.SlowQuery.Threshold
+	slow := threshold > 0 && elapsed >= threshold
+
+	c.mu.Lock()
+	st, ok := c.stats[stmt]
+	if !ok {
+		st = &queryStat{Statement: stmt}
+		c.stats[stmt] = st
+	}
+	st.Count++
+	st.Total += elapsed
+	if elapsed > st.Max {
+		st.Max = elapsed
+	}
+	needsPlan := false
+	if slow {
+		st.Slow++
+		// 同じステートメントにつき、初めて遅かったときだけEXPLAINする
+		needsPlan = config.SlowQuery.Explain && st.Slow == 1
+	}
+	c.mu.Unlock()
+
+	if !slow {
+		return
+	}
+	log.Printf("slow query (%s): %s %v", elapsed, query, args)
+
+	if needsPlan {
+		go c.explain(stmt, query, args)
+	}
+}
+
+func (c *queryStatsCollector) explain(stmt, query string, args []interface{}) {
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// ラップしたDBを通すとEXPLAIN自体も集計されてしまうので、素のsqlxを使う
+	rows, err := db.DB.QueryxContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			log.Print(err)
+			return
+		}
+		keys := make([]string, 0, len(row))
+		for k := range row {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := row[k]
+			if bs, ok := v.([]byte); ok {
+				v = string(bs)
+			}
+			fmt.Fprintf(&b, "%s=%v ", k, v)
+		}
+		b.WriteString("\n")
+	}
+
+	c.mu.Lock()
+	if st, ok := c.stats[stmt]; ok {
+		st.Plan = b.String()
+	}
+	c.mu.Unlock()
+}
+
+// 合計時間の長い順にn件返す
+func (c *queryStatsCollector) top(n int) []queryStat {
+	c.mu.Lock()
+	list := make([]queryStat, 0, len(c.stats))
+	for _, st := range c.stats {
+		list = append(list, *st)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Total > list[j].Total })
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func (c *queryStatsCollector) reset() {
+	c.mu.Lock()
+	c.stats = map[string]*queryStat{}
+	c.mu.Unlock()
+}
+
+// 管理用リスナーの/debug/queries。pt-query-digestの代わりにざっくり眺める用
+func getDebugQueries(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("reset") == "1" {
+		queryStats.reset()
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		n = 20
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "total\tcount\tavg\tmax\tslow\tstatement")
+	top := queryStats.top(n)
+	for _, st := range top {
+		avg := st.Total / time.Duration(st.Count)
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\n", st.Total, st.Count, avg, st.Max, st.Slow, st.Statement)
+	}
+	tw.Flush()
+
+	for _, st := range top {
+		if st.Plan == "" {
+			continue
+		}
+		fmt.Fprintf(w, "\n-- %s\n%s", st.Statement, st.Plan)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 投稿やコメントの回数をトークンバケットで制限する。バケットはmemcachedの
+// "ratelimit.<action>.user.<id>"と"ratelimit.<action>.ip.<ip>"に置くので、インスタンスをまたいで効く。
+// 1秒にrateずつトークンが貯まり(上限burst)、1リクエストで1つ使う
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// 1種類の操作の制限。Rateが0なら制限しない
+type rateLimitRule struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (rule rateLimitRule) enabled() bool {
+	return rule.Rate > 0 && rule.Burst > 0
+}
+
+// バケットからトークンを1つ取る。足りなければ、次のトークンが貯まるまでの時間を返す
+func takeToken(ctx context.Context, key string, rule rateLimitRule) (bool, time.Duration) {
+	allowed := true
+	var retryAfter time.Duration
+	err := memcacheClient.Update(ctx, key, func(value []byte) ([]byte, int32) {
+		now := time.Now()
+		b := tokenBucket{Tokens: float64(rule.Burst), Updated: now}
+		if value != nil {
+			if err := json.Unmarshal(value, &b); err == nil {
+				b.Tokens = math.Min(float64(rule.Burst), b.Tokens+now.Sub(b.Updated).Seconds()*rule.Rate)
+				b.Updated = now
+			}
+		}
+
+		allowed = b.Tokens >= 1
+		retryAfter = 0
+		if allowed {
+			b.Tokens--
+		} else {
+			retryAfter = time.Duration((1 - b.Tokens) / rule.Rate * float64(time.Second))
+		}
+
+		// 満タンになったら消えてよい
+		full := time.Duration((float64(rule.Burst) - b.Tokens) / rule.Rate * float64(time.Second))
+		value, _ = json.Marshal(b)
+		return value, int32(full/time.Second) + 1
+	})
+	if err != nil {
+		// memcachedが使えないときは制限しない
+		log.Print(err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// actionの回数をユーザーごととIPごとに制限するミドルウェア。管理者は制限しない。
+// 本当のクライアントのIPがわからないときは、全員が1つのバケットを取り合うことになるのでIPごとの制限はしない。
+// 超えたら429とRetry-Afterを返す
+func rateLimit(action string, userRule, ipRule rateLimitRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := getSessionUser(r)
+			if me.IsAdmin() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var wait time.Duration
+			if isLogin(me) && userRule.enabled() {
+				if ok, d := takeToken(r.Context(), "ratelimit."+action+".user."+strconv.Itoa(me.ID), userRule); !ok && d > wait {
+					wait = d
+				}
+			}
+			if ip, known := clientIP(r); known && ipRule.enabled() {
+				if ok, d := takeToken(r.Context(), "ratelimit."+action+".ip."+ip, ipRule); !ok && d > wait {
+					wait = d
+				}
+			}
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
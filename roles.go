@@ -0,0 +1,155 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// ユーザーのロール(users.role)と、ロールごとにできること
+type Permission string
+
+const (
+	PermissionBan           Permission = "ban"
+	PermissionDeletePost    Permission = "delete_post"
+	PermissionDeleteComment Permission = "delete_comment"
+	PermissionViewReports   Permission = "view_reports"
+	PermissionManageRoles   Permission = "manage_roles"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// /admin/rolesで選べる順に並べる
+var roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+var rolePermissions = map[string][]Permission{
+	RoleUser: nil,
+	RoleModerator: {
+		PermissionBan,
+		PermissionDeletePost,
+		PermissionDeleteComment,
+		PermissionViewReports,
+	},
+	RoleAdmin: {
+		PermissionBan,
+		PermissionDeletePost,
+		PermissionDeleteComment,
+		PermissionViewReports,
+		PermissionManageRoles,
+	},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// テンプレートからも{{ if .Me.Can "ban" }}のように使う
+func (u User) Can(p Permission) bool {
+	for _, granted := range rolePermissions[u.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// pの権限がないユーザーを通さないミドルウェア。ログインしていなければトップに戻す
+func requirePermission(p Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := getSessionUser(r)
+			if !isLogin(me) {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			if !me.Can(p) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// 一般ユーザー以外のロールを持つユーザーの一覧と、ロールを変えるフォーム
+func getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	users := []User{}
+	err := db.SelectContext(r.Context(), &users, "SELECT * FROM `users` WHERE `role` <> ? AND `del_flg` = 0 ORDER BY `account_name`", RoleUser)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("roles.html")),
+	).Execute(w, struct {
+		Users     []User
+		Roles     []string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{users, roles, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// account_nameのユーザーのロールをroleにする。自分のロールは変えられない(最後の管理者がいなくなるのを防ぐ)
+func postAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	accountName, role := r.FormValue("account_name"), r.FormValue("role")
+
+	notice := ""
+	user := User{}
+	err := db.GetContext(r.Context(), &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	switch {
+	case !validRole(role):
+		notice = "ロールはuser、moderator、adminのどれかです"
+	case err != nil:
+		notice = "アカウントが見つかりません"
+	case user.ID == me.ID:
+		notice = "自分のロールは変更できません"
+	}
+	if notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/roles", http.StatusFound)
+		return
+	}
+
+	err = db.Transaction(r.Context(), func(tx *Tx) error {
+		_, err := tx.ExecContext(r.Context(), "UPDATE `users` SET `role` = ? WHERE `id` = ?", role, user.ID)
+		if err != nil {
+			return err
+		}
+		return logModeration(r.Context(), tx, me.ID, moderationRole, user.ID, user.Role+" -> "+role)
+	})
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// 権限が変わったので、キャッシュしているユーザーを消し、セッションもログインし直させる
+	invalidateUserCache(r.Context(), user.ID)
+	if err := revokeUserSessions(r.Context(), user.ID); err != nil {
+		log.Print(err)
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = user.AccountName + "さんのロールを" + role + "にしました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/admin/roles", http.StatusFound)
+}
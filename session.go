@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/redis/go-redis/v9"
+)
+
+// session.backendで選んだセッションストアを作る。
+//   - cookie: セッションの中身を署名と暗号化をしてCookieに入れる
+//   - memcached: Cookieにはセッションidだけ入れ、中身はmemcachedに置く
+//   - redis: Cookieにはセッションidだけ入れ、中身はRedisに置く
+func newSessionStore() (sessions.Store, error) {
+	keyPairs := sessionKeyPairs(config.Session.Secrets)
+	options := sessionOptions()
+
+	switch config.Session.Backend {
+	case "cookie":
+		s := sessions.NewCookieStore(keyPairs...)
+		s.Options = options
+		s.MaxAge(options.MaxAge)
+		return s, nil
+	case "memcached":
+		s := gsm.NewMemcacheStore(memcacheClient.Client, config.Session.KeyPrefix, keyPairs...)
+		s.Options = options
+		for _, codec := range s.Codecs {
+			if sc, ok := codec.(*securecookie.SecureCookie); ok {
+				sc.MaxAge(options.MaxAge)
+			}
+		}
+		return s, nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     config.Session.Redis.Address,
+			Password: config.Session.Redis.Password,
+			DB:       config.Session.Redis.DB,
+		})
+		return newRedisStore(client, config.Session.KeyPrefix, options, keyPairs...), nil
+	}
+	return nil, fmt.Errorf("unknown session backend %q", config.Session.Backend)
+}
+
+// セッションidを振り直し、中身も空にする。ログイン前に発行されたidを仕込まれていても、
+// ログイン後には使えなくなる(セッション固定攻撃対策)
+func regenerateSession(r *http.Request) *sessions.Session {
+	session := getSession(r)
+	discardStoredSession(r.Context(), session)
+	session.ID = ""
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	return session
+}
+
+// memcachedやRedisに置いたセッションの中身を消す。cookieバックエンドでは何もしない
+func discardStoredSession(ctx context.Context, session *sessions.Session) {
+	if session.ID == "" {
+		return
+	}
+	var err error
+	switch s := store.(type) {
+	case *gsm.MemcacheStore:
+		err = ignoreCacheMiss(memcacheClient.Delete(ctx, s.KeyPrefix+session.ID))
+	case *redisStore:
+		err = s.client.Del(ctx, s.keyPrefix+session.ID).Err()
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// 設定したシークレットからsecurecookie用の署名鍵と暗号化鍵を作る。
+// 先頭のシークレットで署名し、読むときは全部試すので、新しいシークレットを先頭に足せばローテーションできる
+func sessionKeyPairs(secrets []string) [][]byte {
+	var keyPairs [][]byte
+	for _, secret := range secrets {
+		keyPairs = append(keyPairs, deriveKey(secret, "hash"), deriveKey(secret, "block"))
+	}
+	return keyPairs
+}
+
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("isuconp-session-" + purpose))
+	return mac.Sum(nil)
+}
+
+func sessionOptions() *sessions.Options {
+	sameSite := http.SameSiteLaxMode
+	switch config.Session.SameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(config.Session.MaxAge / time.Second),
+		Secure:   config.Session.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// Redisにセッションの中身を置くストア。gsm.MemcacheStoreと同じく、Cookieには署名と暗号化をしたセッションidだけを入れる
+type redisStore struct {
+	client    *redis.Client
+	keyPrefix string
+	Codecs    []securecookie.Codec
+	Options   *sessions.Options
+}
+
+func newRedisStore(client *redis.Client, keyPrefix string, options *sessions.Options, keyPairs ...[]byte) *redisStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(options.MaxAge)
+		}
+	}
+	return &redisStore{
+		client:    client,
+		keyPrefix: keyPrefix,
+		Codecs:    codecs,
+		Options:   options,
+	}
+}
+
+func (s *redisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *redisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	data, err := s.client.Get(r.Context(), s.keyPrefix+session.ID).Result()
+	if err == redis.Nil {
+		// 期限切れか削除済み。新しいセッションとして扱う
+		session.ID = ""
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *redisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.client.Del(r.Context(), s.keyPrefix+session.ID).Err(); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.client.Set(r.Context(), s.keyPrefix+session.ID, data, ttl).Err(); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
@@ -1,3 +1,8 @@
 #!/bin/bash
 
 make
+
+# /initializeはISUCONP_INITIALIZE_SECRET(X-Initialize-Tokenヘッダーで渡す)か
+# ISUCONP_BENCHMARK_MODE=trueを設定しないと403になる。ベンチマーカーを回すときは
+#   ISUCONP_BENCHMARK_MODE=true ./app
+# のように起動する
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ログイン中のユーザーは、リクエストをまたいでmemcachedに"user.<id>"としてキャッシュする。
+// BANや権限の変更をしたらinvalidateUserCacheで消す
+const userCacheTTL = time.Minute
+
+type sessionUserKey struct{}
+
+func userCacheKey(id int) string {
+	return "user." + strconv.Itoa(id)
+}
+
+// idのユーザーをキャッシュ経由で取得する
+func getUserByID(ctx context.Context, id int) (User, error) {
+	key := userCacheKey(id)
+	u := User{}
+
+	item, err := appCache.Get(ctx, key)
+	if err == nil {
+		if err := json.Unmarshal(item.Value, &u); err == nil {
+			return u, nil
+		}
+	} else if err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+
+	err = db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `id` = ?", id)
+	if err != nil {
+		return User{}, err
+	}
+
+	if b, err := json.Marshal(u); err == nil {
+		err = appCache.Set(ctx, &memcache.Item{Key: key, Value: b, Expiration: jitteredExpiration(userCacheTTL)})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return u, nil
+}
+
+func invalidateUserCache(ctx context.Context, ids ...int) {
+	for _, id := range ids {
+		err := appCache.Delete(ctx, userCacheKey(id))
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+}
+
+// セッションのuser_idを取り出す。ログイン時はint、登録時はint64で入っている
+func sessionUserID(r *http.Request) int {
+	switch uid := getSession(r).Values["user_id"].(type) {
+	case int:
+		return uid
+	case int64:
+		return int(uid)
+	}
+	return 0
+}
+
+// ログイン中のユーザーをリクエストごとに一度だけ読み込んでctxに入れておく。
+// getSessionUserを何度呼んでもSELECTは走らない
+func sessionUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := loadSessionUser(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, &u)))
+	})
+}
+
+func loadSessionUser(r *http.Request) User {
+	uid := sessionUserID(r)
+	if uid == 0 {
+		return User{}
+	}
+	// ログアウトやBANで消されたセッションはログインしていないものとして扱う
+	if !userSessionActive(r.Context(), uid, sessionID(r)) {
+		return User{}
+	}
+
+	u, err := getUserByID(r.Context(), uid)
+	if err != nil {
+		return User{}
+	}
+	return u
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// ログイン中のセッションはuser_sessionsテーブルにユーザーごとに記録する。
+// セッションにはuser_idと一緒にsidを入れておき、リクエストごとにsidがまだ残っているかを確かめるので、
+// 行を消せばバックエンドがcookieでもそのセッションはすぐに使えなくなる。
+// 確認結果は"user_session.<sid>"としてキャッシュする(ほかのインスタンスのLRUにはcache.local_ttlだけ残る)
+type UserSession struct {
+	ID        string    `db:"id"`
+	UserID    int       `db:"user_id"`
+	UserAgent string    `db:"user_agent"`
+	IPAddress string    `db:"ip_address"`
+	CreatedAt time.Time `db:"created_at"`
+	Current   bool      `db:"-"`
+}
+
+func userSessionCacheKey(sid string) string {
+	return "user_session." + sid
+}
+
+func sessionID(r *http.Request) string {
+	sid, _ := getSession(r).Values["sid"].(string)
+	return sid
+}
+
+// ログインと登録のときに呼ぶ。セッションidを振り直して新しいsidを記録する
+func startUserSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	session := regenerateSession(r)
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	sid := secureRandomStr(16)
+	ip, _ := clientIP(r)
+	_, err := db.ExecContext(r.Context(),
+		"INSERT INTO `user_sessions` (`id`, `user_id`, `user_agent`, `ip_address`) VALUES (?, ?, ?, ?)",
+		sid, userID, userAgent, ip)
+	if err != nil {
+		return err
+	}
+
+	session.Values["user_id"] = userID
+	session.Values["sid"] = sid
+	session.Values["csrf_token"] = secureRandomStr(16)
+	return session.Save(r, w)
+}
+
+// ログアウトしたセッションの記録と中身を消し、Cookieを期限切れにする
+func endUserSession(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if sid, ok := session.Values["sid"].(string); ok {
+		_, err := db.ExecContext(r.Context(), "DELETE FROM `user_sessions` WHERE `id` = ?", sid)
+		if err != nil {
+			log.Print(err)
+		}
+		invalidateUserSessionCache(r.Context(), sid)
+	}
+	discardStoredSession(r.Context(), session)
+
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	// Path、HttpOnlyなどはそのままにして、有効期限だけ切る
+	opts := *session.Options
+	opts.MaxAge = -1
+	session.Options = &opts
+	session.Save(r, w)
+}
+
+// sidがuserIDの有効なセッションかどうか。見つからなかったsidも"0"としてキャッシュする
+func userSessionActive(ctx context.Context, userID int, sid string) bool {
+	if sid == "" {
+		return false
+	}
+	key := userSessionCacheKey(sid)
+
+	item, err := appCache.Get(ctx, key)
+	if err == nil {
+		return string(item.Value) == strconv.Itoa(userID)
+	}
+	if err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+
+	owner := 0
+	err = db.GetContext(ctx, &owner,
+		"SELECT `user_id` FROM `user_sessions` WHERE `id` = ? AND `created_at` > ?",
+		sid, time.Now().Add(-config.Session.MaxAge))
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return false
+	}
+
+	err = appCache.Set(ctx, &memcache.Item{Key: key, Value: []byte(strconv.Itoa(owner)), Expiration: jitteredExpiration(userCacheTTL)})
+	if err != nil {
+		log.Print(err)
+	}
+	return owner == userID
+}
+
+// ユーザーの有効なセッションを新しい順に返す
+func listUserSessions(ctx context.Context, userID int) ([]UserSession, error) {
+	sessions := []UserSession{}
+	err := db.SelectContext(ctx, &sessions,
+		"SELECT * FROM `user_sessions` WHERE `user_id` = ? AND `created_at` > ? ORDER BY `created_at` DESC",
+		userID, time.Now().Add(-config.Session.MaxAge))
+	return sessions, err
+}
+
+// ユーザーのセッションをすべて無効にする。すべての端末からのログアウト、BAN、権限の変更のときに呼ぶ
+func revokeUserSessions(ctx context.Context, userIDs ...int) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT `id` FROM `user_sessions` WHERE `user_id` IN (?)", userIDs)
+	if err != nil {
+		return err
+	}
+	var sids []string
+	if err := db.SelectContext(ctx, &sids, query, args...); err != nil {
+		return err
+	}
+
+	query, args, err = sqlx.In("DELETE FROM `user_sessions` WHERE `user_id` IN (?)", userIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	invalidateUserSessionCache(ctx, sids...)
+	return nil
+}
+
+// session.max_ageを過ぎたセッションの行を消して、消した件数を返す。
+// 読むときもcreated_atで絞っているので、消すのが遅れても期限切れのセッションは使えない
+func purgeUserSessions(ctx context.Context) (int64, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM `user_sessions` WHERE `created_at` <= ?", time.Now().Add(-config.Session.MaxAge))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// session.purge_intervalごとに期限切れのセッションを消す
+func watchUserSessionExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := purgeUserSessions(ctx); err != nil {
+				log.Print(err)
+			} else if n > 0 {
+				log.Printf("purged %d expired sessions", n)
+			}
+		}
+	}
+}
+
+func invalidateUserSessionCache(ctx context.Context, sids ...string) {
+	for _, sid := range sids {
+		err := appCache.Delete(ctx, userSessionCacheKey(sid))
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+}
+
+// すべての端末からログアウトする。このリクエストのセッションも含めて消す
+func postLogoutAll(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if err := revokeUserSessions(r.Context(), me.ID); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	endUserSession(w, r)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}